@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+//Kind of the records of the pending approvals; Their keys are token:userID
+const approvalRecords = "approval"
+
+//A user who passed the captcha of a token which needs the approval of an admin
+type approval struct {
+	Token    string
+	Source   string
+	User     tgbotapi.User
+	ChatID   int64
+	Created  time.Time
+	Messages []chatMessage //The requests which are sent to the admins; They are edited after the decision
+}
+
+type chatMessage struct {
+	ChatID    int64
+	MessageID int
+}
+
+//Send the value or ask the admins to approve it if the token needs approval
+func revealOrAskApproval(chatID int64, user tgbotapi.User, token, source string) {
+	meta, err := store.ReadMeta(token)
+	if err != nil {
+		botSend(tgbotapi.NewMessage(chatID, tr(chatID, "database_error", err.Error())))
+		return
+	}
+	if !meta.Approval {
+		sendValueWithBot(chatID, user, token)
+		return
+	}
+	key := token + ":" + strconv.Itoa(user.ID)
+	a := approval{Token: token, Source: source, User: user, ChatID: chatID, Created: time.Now()}
+	//The request is reserved before sending it so the admins do not receive the same request twice
+	added, err := addJSONRecord(approvalRecords, key, a)
+	if err != nil {
+		log.Println("Cannot save the approval request:", err.Error())
+		botSend(tgbotapi.NewMessage(chatID, tr(chatID, "save_error", err.Error())))
+		return
+	}
+	if !added {
+		botSend(tgbotapi.NewMessage(chatID, trToken(chatID, token, "approval_waiting")))
+		return
+	}
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Approve", "approve:"+key),
+		tgbotapi.NewInlineKeyboardButtonData("Deny", "deny:"+key),
+	))
+	for _, chat := range approvalChats() {
+		msg := tgbotapi.NewMessage(chat, a.text())
+		msg.ReplyMarkup = keyboard
+		sent, err := botSendWait(msg)
+		if err != nil {
+			continue
+		}
+		a.Messages = append(a.Messages, chatMessage{sent.Chat.ID, sent.MessageID})
+	}
+	if len(a.Messages) == 0 { //Nobody can approve it so the user must be able to ask again
+		log.Println("Cannot send the approval request of", user.ID, "for", token, "to any of the admins")
+		_ = store.DeleteRecord(approvalRecords, key)
+		botSend(tgbotapi.NewMessage(chatID, trToken(chatID, token, "approval_failed")))
+		return
+	}
+	//An admin may decide before the messages are saved; Then the user is already told and the request is not saved again
+	if err = replaceJSONRecord(approvalRecords, key, a); err == errRecordNotFound {
+		return
+	} else if err != nil { //The reserved request can still be decided; Only the messages of the admins are not edited
+		log.Println("Cannot save the messages of the approval request:", err.Error())
+	}
+	botSend(tgbotapi.NewMessage(chatID, trToken(chatID, token, "approval_asked")))
+}
+
+//The chats which receive the approval requests
+func approvalChats() []int64 {
+	if Config.ApprovalChat != 0 {
+		return []int64{Config.ApprovalChat}
+	}
+	chats := make([]int64, len(Config.Admins))
+	for i, admin := range Config.Admins {
+		chats[i] = int64(admin)
+	}
+	return chats
+}
+
+//The request which admins see
+func (a approval) text() string {
+	name := strings.TrimSpace(a.User.FirstName + " " + a.User.LastName)
+	text := fmt.Sprintf("%s wants to receive the token %s\nUser ID: %d", name, a.Token, a.User.ID)
+	if a.User.UserName != "" {
+		text += "\nUsername: @" + a.User.UserName
+	}
+	if a.Source != "" {
+		text += "\nSource: " + a.Source
+	}
+	return text + "\nRequested at: " + a.Created.Format("2006-01-02 15:04")
+}
+
+//Approve or deny a pending request when an admin presses its button
+func decideApproval(query *tgbotapi.CallbackQuery, key string, approved bool) {
+	var a approval
+	if err := takeJSONRecord(approvalRecords, key, &a); err != nil {
+		if err != errRecordNotFound {
+			log.Println("Cannot read the approval request:", err.Error())
+		}
+		botSend(tgbotapi.NewMessage(query.Message.Chat.ID, "This request is not pending anymore."))
+		return
+	}
+	decision := "Denied"
+	if approved {
+		decision = "Approved"
+	}
+	decision += " by " + strings.TrimSpace(query.From.FirstName+" "+query.From.LastName)
+	for _, m := range a.Messages {
+		botSend(tgbotapi.NewEditMessageText(m.ChatID, m.MessageID, a.text()+"\n\n"+decision))
+	}
+	if approved {
+		botSend(tgbotapi.NewMessage(a.ChatID, trToken(a.ChatID, a.Token, "approval_approved")))
+		sendValueWithBot(a.ChatID, a.User, a.Token)
+	} else {
+		botSend(tgbotapi.NewMessage(a.ChatID, trToken(a.ChatID, a.Token, "approval_denied")))
+	}
+}
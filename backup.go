@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const backupPrefix = "captchabot-"
+const backupSuffix = ".db"
+const backupTimeFormat = "2006-01-02-150405"
+
+//Telegram does not let bots upload files bigger than 50MB
+const maxUploadSize = 50 * 1024 * 1024
+
+//Write a snapshot of the database into the directory while the bot is running
+//Returns the path of the snapshot
+func BackupDB(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("could not create the backup directory: %v", err)
+	}
+	snapshotter, ok := baseStore(store).(fileStore)
+	if !ok {
+		return "", errNotSupported
+	}
+	name := filepath.Join(dir, backupPrefix+time.Now().Format(backupTimeFormat)+backupSuffix)
+	//Write to a temp file at first to never leave a half written backup
+	temp := filepath.Join(dir, "tmp-"+strconv.FormatInt(time.Now().UnixNano(), 36))
+	err := snapshotter.Snapshot(temp)
+	if err == nil {
+		err = os.Rename(temp, name)
+	}
+	if err != nil {
+		_ = os.Remove(temp)
+		return "", fmt.Errorf("could not write the backup: %v", err)
+	}
+	return name, nil
+}
+
+//Remove the old snapshots of dir. The newest snapshot of each of the last keepDaily days and
+//the newest snapshot of each of the last keepWeekly weeks are kept
+func RotateBackups(dir string, keepDaily, keepWeekly int) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	type snapshot struct {
+		name string
+		time time.Time
+	}
+	var snapshots []snapshot
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix) {
+			continue
+		}
+		t, err := time.ParseInLocation(backupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), backupSuffix), time.Local)
+		if err != nil {
+			continue //Not ours
+		}
+		snapshots = append(snapshots, snapshot{name, t})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { //Newest first
+		return snapshots[i].time.After(snapshots[j].time)
+	})
+	days := make(map[string]bool)
+	weeks := make(map[string]bool)
+	for _, s := range snapshots {
+		keep := false
+		day := s.time.Format(dayFormat)
+		if !days[day] && len(days) < keepDaily {
+			days[day] = true
+			keep = true
+		}
+		year, w := s.time.ISOWeek()
+		week := fmt.Sprint(year, "-", w)
+		if !weeks[week] && len(weeks) < keepWeekly {
+			weeks[week] = true
+			keep = true
+		}
+		if !keep {
+			if err = os.Remove(filepath.Join(dir, s.name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//Take a backup, rotate the old ones and send it to the backup chat if needed
+func runBackup() {
+	name, err := BackupDB(Config.Backup.Dir)
+	if err != nil {
+		log.Println("Cannot backup the database:", err.Error())
+		return
+	}
+	log.Println("Saved a backup of the database in", name)
+	keepDaily, keepWeekly := Config.Backup.KeepDaily, Config.Backup.KeepWeekly
+	if keepDaily == 0 && keepWeekly == 0 {
+		keepDaily, keepWeekly = 7, 4
+	}
+	if err = RotateBackups(Config.Backup.Dir, keepDaily, keepWeekly); err != nil {
+		log.Println("Cannot remove the old backups:", err.Error())
+	}
+	if Config.Backup.SendTo != 0 {
+		sendBackup(Config.Backup.SendTo, name)
+	}
+}
+
+//Send a snapshot file to a chat
+func sendBackup(chatID int64, name string) {
+	if info, err := os.Stat(name); err == nil && info.Size() > maxUploadSize {
+		botSend(tgbotapi.NewMessage(chatID, "The backup is too big to be sent via Telegram. It is saved in "+name))
+		return
+	}
+	msg := tgbotapi.NewDocumentUpload(chatID, name)
+	msg.Caption = "Backup of " + time.Now().Format("2006-01-02 15:04")
+	_, _ = botSendWait(msg) //Wait because the file might be removed after; The errors are logged by the send queue
+}
+
+//Take backups periodically; This function never returns
+func backupLoop() {
+	interval := time.Duration(Config.Backup.Interval) * time.Minute
+	if interval <= 0 {
+		interval = 24 * time.Hour
+	}
+	for range time.Tick(interval) {
+		runBackup()
+	}
+}
+
+//Replace the database file with a backup. This must be called before the database is loaded
+func RestoreDB(kind, backup, dataBaseName string) error {
+	var err error
+	switch kind {
+	case "", "bolt":
+		err = checkBoltFile(backup)
+	case "sqlite":
+		err = checkSQLiteFile(backup)
+	default:
+		return errNotSupported
+	}
+	if err != nil {
+		return err
+	}
+	//Keep the current database just in case
+	if _, err = os.Stat(dataBaseName); err == nil {
+		if kind == "" || kind == "bolt" { //Make sure that another bot is not using it
+			current, err := bolt.Open(dataBaseName, 0600, &bolt.Options{Timeout: time.Second})
+			if err != nil {
+				return fmt.Errorf("could not open the current database: %v", err)
+			}
+			_ = current.Close()
+		}
+		if err = os.Rename(dataBaseName, dataBaseName+".old"); err != nil {
+			return fmt.Errorf("could not move the current database: %v", err)
+		}
+		log.Println("The current database is moved to", dataBaseName+".old")
+	}
+	src, err := os.Open(backup)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(dataBaseName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+//Make sure that the backup is a valid bolt database
+func checkBoltFile(name string) error {
+	check, err := bolt.Open(name, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("could not open the backup: %v", err)
+	}
+	var problems []string
+	err = check.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() { //The channel is drained so the check is done before the file is closed
+			problems = append(problems, err.Error())
+		}
+		return nil
+	})
+	_ = check.Close()
+	if err != nil {
+		return fmt.Errorf("could not check the backup: %v", err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("the backup is corrupted: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
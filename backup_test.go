@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRotateBackups(t *testing.T) {
+	dir := t.TempDir()
+	snapshots := map[string]bool{ //The time of the snapshot and if it is kept
+		"2024-01-15 12:00": true,  //The newest one of Monday and of week 3
+		"2024-01-15 08:00": false, //Older one of the same day
+		"2024-01-14 10:00": true,  //The newest one of week 2
+		"2024-01-13 10:00": true,  //The third day
+		"2024-01-12 10:00": false,
+		"2024-01-05 10:00": true, //The newest one of week 1
+		"2024-01-04 10:00": false,
+		"2023-12-28 10:00": false, //The fourth week
+	}
+	var want []string
+	for at, keep := range snapshots {
+		when, err := time.ParseInLocation("2006-01-02 15:04", at, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := backupPrefix + when.Format(backupTimeFormat) + backupSuffix
+		if err = ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if keep {
+			want = append(want, name)
+		}
+	}
+	//Other files of the directory are never removed
+	for _, name := range []string{"notes.txt", backupPrefix + "manual" + backupSuffix} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, name)
+	}
+	if err := os.Mkdir(filepath.Join(dir, backupPrefix+"2020-01-01-000000"+backupSuffix), 0700); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, backupPrefix+"2020-01-01-000000"+backupSuffix)
+
+	if err := RotateBackups(dir, 3, 3); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, file := range files {
+		got = append(got, file.Name())
+	}
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+//Kind of the records of the banned users; Their keys are the user IDs
+const banRecords = "ban"
+
+//A banned user
+type ban struct {
+	ID      int
+	Reason  string
+	By      int //The admin who banned the user; 0 for the automatic bans
+	Created time.Time
+	Until   time.Time //Zero means forever
+}
+
+//The recent failures of the users for the automatic ban
+var failures = struct {
+	mux   sync.Mutex
+	times map[int][]time.Time
+}{times: make(map[int][]time.Time)}
+
+//Check if a user is banned; Admins are never banned
+func isBanned(id int) bool {
+	if checkInArray(id, Config.Admins) {
+		return false
+	}
+	var b ban
+	if err := getJSONRecord(banRecords, strconv.Itoa(id), &b); err != nil {
+		if err != errRecordNotFound {
+			log.Println("Cannot read the ban of", id, ":", err.Error())
+		}
+		return false
+	}
+	if !b.Until.IsZero() && time.Now().After(b.Until) { //The ban is over
+		_ = store.DeleteRecord(banRecords, strconv.Itoa(id))
+		return false
+	}
+	return true
+}
+
+//Tell the banned user that they are banned unless the bot should be silent
+func sendBanMessage(chatID int64) {
+	if Config.Ban.Silent {
+		return
+	}
+	text := Config.Ban.Message
+	if text == "" {
+		text = tr(chatID, "banned")
+	}
+	botSend(tgbotapi.NewMessage(chatID, text))
+}
+
+func banUser(b ban) error {
+	b.Created = time.Now()
+	return putJSONRecord(banRecords, strconv.Itoa(b.ID), b)
+}
+
+//Record a failed captcha or an invalid token and ban the user if they fail too much
+func recordFailure(id int) {
+	if Config.Ban.Failures <= 0 || checkInArray(id, Config.Admins) {
+		return
+	}
+	window := time.Duration(Config.Ban.Window) * time.Minute
+	if window <= 0 {
+		window = 10 * time.Minute
+	}
+	now := time.Now()
+	failures.mux.Lock()
+	recent := failures.times[id][:0]
+	for _, t := range failures.times[id] {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	exceeded := len(recent) >= Config.Ban.Failures
+	if exceeded {
+		delete(failures.times, id)
+	} else {
+		failures.times[id] = recent
+	}
+	failures.mux.Unlock()
+	if !exceeded {
+		return
+	}
+	b := ban{ID: id, Reason: fmt.Sprintf("%d failures in %s", Config.Ban.Failures, window)}
+	if Config.Ban.Duration > 0 {
+		b.Until = now.Add(time.Duration(Config.Ban.Duration) * time.Minute)
+	}
+	if err := banUser(b); err != nil {
+		log.Println("Cannot ban", id, ":", err.Error())
+		return
+	}
+	notifyAdmins(fmt.Sprintf("User `%d` is banned automatically because of %s. Use `/unban %d` to unban them.", id, escapeMarkdown(b.Reason), id))
+}
+
+//Find the ID of a user from an ID or a @username of the users who have used the bot
+func findUserID(str string) (int, error) {
+	if !strings.HasPrefix(str, "@") {
+		id, err := strconv.Atoi(str)
+		if err != nil {
+			return 0, fmt.Errorf("invalid user %q; use the ID or the @username", str)
+		}
+		return id, nil
+	}
+	username := strings.TrimPrefix(str, "@")
+	id := 0
+	err := store.ForEachRecord(userRecords, func(_ string, value []byte) error {
+		var u botUser
+		if json.Unmarshal(value, &u) == nil && strings.EqualFold(u.UserName, username) {
+			id = u.ID
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if id == 0 {
+		return 0, fmt.Errorf("there is no user with username %s; They must have used the bot before", str)
+	}
+	return id, nil
+}
+
+//The list of the banned users
+func bansText() (string, error) {
+	var bans []ban
+	err := store.ForEachRecord(banRecords, func(_ string, value []byte) error {
+		var b ban
+		if err := json.Unmarshal(value, &b); err == nil && (b.Until.IsZero() || time.Now().Before(b.Until)) {
+			bans = append(bans, b)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(bans) == 0 {
+		return "There is no banned user.", nil
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Created.Before(bans[j].Created) })
+	var sb strings.Builder
+	sb.WriteString("Banned users:\n")
+	for _, b := range bans {
+		sb.WriteString(strconv.Itoa(b.ID))
+		if b.Reason != "" {
+			sb.WriteString(" : " + b.Reason)
+		}
+		if !b.Until.IsZero() {
+			sb.WriteString(" (until " + b.Until.Format("2006-01-02 15:04") + ")")
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+//Kind of the records of the running broadcasts; They are removed when the broadcast finishes
+const broadcastRecords = "broadcast"
+
+//The progress is saved after sending this many messages
+const broadcastSaveEvery = 20
+
+//A message which is being copied to the users
+type broadcast struct {
+	ID        string
+	AdminChat int64 //The chat which receives the report
+	FromChat  int64
+	MessageID int
+	Token     string  //Empty if the message is sent to all users
+	Targets   []int64 //The chats to send the message to
+	Next      int     //Index of the next target
+	Sent      int
+	Failed    int
+	Blocked   int
+	Started   time.Time
+}
+
+//Start sending a message which an admin sent to the users
+func startBroadcast(message *tgbotapi.Message, token string) {
+	users, err := readUsers(token)
+	if err != nil {
+		botSend(tgbotapi.NewMessage(message.Chat.ID, "Cannot read the users: "+err.Error()))
+		return
+	}
+	b := broadcast{
+		ID:        strconv.FormatInt(time.Now().UnixNano(), 36),
+		AdminChat: message.Chat.ID,
+		FromChat:  message.Chat.ID,
+		MessageID: message.MessageID,
+		Token:     token,
+		Started:   time.Now(),
+	}
+	for _, u := range users {
+		b.Targets = append(b.Targets, int64(u.ID))
+	}
+	if len(b.Targets) == 0 {
+		botSend(tgbotapi.NewMessage(message.Chat.ID, "There is no user to send the message to."))
+		return
+	}
+	if err = putJSONRecord(broadcastRecords, b.ID, b); err != nil {
+		botSend(tgbotapi.NewMessage(message.Chat.ID, "Cannot save the broadcast: "+err.Error()))
+		return
+	}
+	botSend(tgbotapi.NewMessage(message.Chat.ID, fmt.Sprintf("Sending the message to %d users. You will get a report when it finishes.", len(b.Targets))))
+	runBroadcast(b)
+}
+
+//Continue the broadcasts which were running when the bot stopped
+func resumeBroadcasts() {
+	var broadcasts []broadcast
+	err := store.ForEachRecord(broadcastRecords, func(_ string, value []byte) error {
+		var b broadcast
+		if err := json.Unmarshal(value, &b); err != nil {
+			log.Println("Skipping corrupted broadcast:", err.Error())
+			return nil
+		}
+		broadcasts = append(broadcasts, b)
+		return nil
+	})
+	if err != nil {
+		log.Println("Cannot read the broadcasts:", err.Error())
+		return
+	}
+	for _, b := range broadcasts {
+		log.Println("Resuming broadcast", b.ID, "from", b.Next, "of", len(b.Targets))
+		go runBroadcast(b)
+	}
+}
+
+//Send the message to the remaining targets and report the result
+func runBroadcast(b broadcast) {
+	for b.Next < len(b.Targets) {
+		target := b.Targets[b.Next]
+		switch err := copyMessage(target, b.FromChat, b.MessageID); {
+		case err == nil:
+			b.Sent++
+		case isBlockedError(err): //The send queue marks the user as blocked
+			b.Blocked++
+		default:
+			b.Failed++
+			log.Println("Cannot send the broadcast to", target, ":", err.Error())
+		}
+		b.Next++
+		if b.Next%broadcastSaveEvery == 0 {
+			if err := putJSONRecord(broadcastRecords, b.ID, b); err != nil {
+				log.Println("Cannot save the progress of the broadcast:", err.Error())
+			}
+		}
+	}
+	if err := store.DeleteRecord(broadcastRecords, b.ID); err != nil {
+		log.Println("Cannot remove the broadcast:", err.Error())
+	}
+	botSend(tgbotapi.NewMessage(b.AdminChat, fmt.Sprintf("Broadcast finished in %s.\nSent: %d\nFailed: %d\nBlocked the bot: %d",
+		time.Since(b.Started).Round(time.Second), b.Sent, b.Failed, b.Blocked)))
+}
+
+//Copy a message to a chat through the send queue
+func copyMessage(chatID, fromChat int64, messageID int) error {
+	_, err := botRequestWait(chatID, "copyMessage", url.Values{
+		"chat_id":      {strconv.FormatInt(chatID, 10)},
+		"from_chat_id": {strconv.FormatInt(fromChat, 10)},
+		"message_id":   {strconv.Itoa(messageID)},
+	})
+	return err
+}
+
+//Telegram answers with "Forbidden: ..." (403) when the user has blocked the bot or deleted their account
+//The library only keeps the description of the errors so it is checked instead of the code
+func isBlockedError(err error) bool {
+	description, refused := telegramError(err)
+	if !refused {
+		return false
+	}
+	return strings.HasPrefix(description, "Forbidden") ||
+		strings.Contains(description, "bot was blocked by the user") ||
+		strings.Contains(description, "user is deactivated")
+}
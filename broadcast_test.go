@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+func TestIsBlockedError(t *testing.T) {
+	tests := []struct {
+		err     error
+		blocked bool
+	}{
+		{tgbotapi.Error{Message: "Forbidden: bot was blocked by the user"}, true},
+		{tgbotapi.Error{Message: "Forbidden: user is deactivated"}, true},
+		{tgbotapi.Error{Message: "Forbidden: bot can't initiate conversation with a user"}, true},
+		{tgbotapi.Error{Message: "Bad Request: chat not found"}, false},
+		{tgbotapi.Error{Message: "Too Many Requests: retry after 5", ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 5}}, false},
+		{errors.New("Forbidden: bot was blocked by the user"), true}, //Uploads only return the description
+		{errors.New("Bad Request: chat not found"), false},
+		{&url.Error{Op: "Post", URL: "https://api.telegram.org", Err: errors.New("Forbidden: bot was blocked by the user")}, false},
+		{nil, false},
+	}
+	for _, test := range tests {
+		if got := isBlockedError(test.err); got != test.blocked {
+			t.Errorf("isBlockedError(%v) = %v, want %v", test.err, got, test.blocked)
+		}
+	}
+}
+
+func TestTelegramError(t *testing.T) {
+	tests := []struct {
+		err        error
+		refused    bool
+		retryAfter time.Duration
+	}{
+		{tgbotapi.Error{Message: "Bad Request: chat not found"}, true, 0},
+		{tgbotapi.Error{Message: "Too Many Requests: retry after 5", ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 5}}, true, 5 * time.Second},
+		{errors.New("Too Many Requests: retry after 7"), true, 7 * time.Second}, //Uploads lose the parameters
+		{errors.New("Bad Request: PHOTO_INVALID_DIMENSIONS"), true, 0},
+		{&url.Error{Op: "Post", URL: "https://api.telegram.org", Err: errors.New("connection reset by peer")}, false, 0},
+		{errors.New("invalid character '<' looking for beginning of value"), false, 0},
+	}
+	for _, test := range tests {
+		description, refused := telegramError(test.err)
+		if refused != test.refused {
+			t.Errorf("telegramError(%v) = %v, want %v", test.err, refused, test.refused)
+		}
+		if wait := floodWait(test.err, description); wait != test.retryAfter {
+			t.Errorf("floodWait(%v) = %v, want %v", test.err, wait, test.retryAfter)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+//Telegram does not let bots download files bigger than 20MB
+const maxDownloadSize = 20 * 1024 * 1024
+
+//A row of a bulk import file. In CSV files the header names the columns
+type bulkRow struct {
+	Value  string
+	Key    string //Optional custom token
+	Expire string //Optional time or duration from now
+	Limit  int    //Optional usage limit
+}
+
+//The result of inserting a bulkRow
+type bulkResult struct {
+	Token string
+	Err   error
+}
+
+//Download a file which a user sent to bot
+func downloadFile(fileID string) ([]byte, error) {
+	link, err := bot.GetFileDirectURL(fileID)
+	if err != nil {
+		return nil, fmt.Errorf("could not get the file link: %v", err)
+	}
+	resp, err := http.Get(link)
+	if err != nil {
+		return nil, fmt.Errorf("could not download the file: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not download the file: %s", resp.Status)
+	}
+	//One more byte is read to find out if the file is bigger than the limit
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDownloadSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("could not download the file: %v", err)
+	}
+	if len(data) > maxDownloadSize {
+		return nil, fmt.Errorf("the file is bigger than %dMB", maxDownloadSize/1024/1024)
+	}
+	return data, nil
+}
+
+//Parse a bulk file; JSON files are an array of bulkRow objects, others are treated as CSV
+func parseBulkFile(name string, data []byte) ([]bulkRow, error) {
+	data = bytes.TrimSpace(data)
+	if strings.HasSuffix(strings.ToLower(name), ".json") || bytes.HasPrefix(data, []byte("[")) {
+		var rows []bulkRow
+		if err := json.Unmarshal(data, &rows); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %v", err)
+		}
+		return rows, nil
+	}
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %v", err)
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("the CSV file must have a header and at least one row")
+	}
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["value"]; !ok {
+		return nil, fmt.Errorf("the CSV file must have a value column")
+	}
+	get := func(record []string, column string) string {
+		if i, ok := columns[column]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	rows := make([]bulkRow, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := bulkRow{Value: record[columns["value"]], Key: get(record, "key"), Expire: get(record, "expire")}
+		if limit := get(record, "limit"); limit != "" {
+			row.Limit, err = strconv.Atoi(limit)
+			if err != nil {
+				row.Limit = -1 //Reported as an error when inserting
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+//Parse a time which is either absolute or a duration from now
+func parseTime(str string) (time.Time, error) {
+	if d, err := time.ParseDuration(str); err == nil {
+		return time.Now().Add(d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04", "2006-01-02T15:04", dayFormat} {
+		if t, err := time.ParseInLocation(layout, str, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q; use a duration like 72h or a time like 2006-01-02 15:04", str)
+}
+
+//Custom keys follow the rules of the sources because they are in deep links too
+func validKey(key string) bool {
+	return validSource(key)
+}
+
+//Validate the rows and convert them to the values which are inserted
+func (row bulkRow) toValue() (bulkValue, error) {
+	value := bulkValue{Key: row.Key, Value: row.Value}
+	if strings.TrimSpace(row.Value) == "" {
+		return value, fmt.Errorf("empty value")
+	}
+	if row.Key != "" && !validKey(row.Key) {
+		return value, fmt.Errorf("the key can only contain letters, numbers and underscore and must be at most %d characters", maxSourceLength)
+	}
+	if row.Limit < 0 {
+		return value, fmt.Errorf("invalid limit")
+	}
+	value.Meta.MaxUses = row.Limit
+	if row.Expire != "" {
+		expire, err := parseTime(row.Expire)
+		if err != nil {
+			return value, err
+		}
+		value.Meta.Expire = expire
+	}
+	return value, nil
+}
+
+//Import a bulk file which the admin sent and send back the result as a CSV file
+func processBulkFile(chatID int64, document *tgbotapi.Document) {
+	data, err := downloadFile(document.FileID)
+	if err != nil {
+		botSend(tgbotapi.NewMessage(chatID, "Error on downloading the file: "+err.Error()))
+		return
+	}
+	rows, err := parseBulkFile(document.FileName, data)
+	if err != nil {
+		botSend(tgbotapi.NewMessage(chatID, "Error on reading the file: "+err.Error()))
+		return
+	}
+	results := make([]bulkResult, len(rows))
+	values := make([]bulkValue, 0, len(rows))
+	indexes := make([]int, 0, len(rows)) //The index of each value in rows
+	for i, row := range rows {
+		value, err := row.toValue()
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		values = append(values, value)
+		indexes = append(indexes, i)
+	}
+	inserted, err := store.InsertValues(values)
+	if err != nil {
+		log.Println("Error on bulk insert:", err.Error())
+		botSend(tgbotapi.NewMessage(chatID, "Error in inserting the values in database: "+err.Error()))
+		return
+	}
+	for i, result := range inserted {
+		results[indexes[i]] = result
+	}
+	//Build the result file
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	_ = w.Write([]string{"row", "token", "link", "error"})
+	failed := 0
+	for i, result := range results {
+		record := []string{strconv.Itoa(i + 1), result.Token, "", ""}
+		if result.Err != nil {
+			failed++
+			record[3] = result.Err.Error()
+		} else {
+			record[2] = deepLink(result.Token, "")
+		}
+		_ = w.Write(record)
+	}
+	w.Flush()
+	msg := tgbotapi.NewDocumentUpload(chatID, tgbotapi.FileBytes{Bytes: buf.Bytes(), Name: "tokens.csv"})
+	msg.Caption = fmt.Sprintf("Created %d tokens; %d rows failed.", len(rows)-failed, failed)
+	botSend(msg)
+}
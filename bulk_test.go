@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseBulkFile(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []bulkRow //Nil if the file is invalid
+	}{
+		{"tokens.csv", "value,key,expire,limit\nhello,custom,72h,3\nworld,,,\n", []bulkRow{
+			{Value: "hello", Key: "custom", Expire: "72h", Limit: 3},
+			{Value: "world"},
+		}},
+		{"tokens.csv", " Limit , VALUE \n5, spaced value \n6,next\n", []bulkRow{{Value: " spaced value ", Limit: 5}, {Value: "next", Limit: 6}}},
+		{"tokens.csv", "value,limit\nhello,many\n", []bulkRow{{Value: "hello", Limit: -1}}},
+		{"tokens.csv", "value,key\n\"a, b\",k\n", []bulkRow{{Value: "a, b", Key: "k"}}},
+		{"tokens.csv", "value\n", nil},
+		{"tokens.csv", "key,limit\nabc,3\n", nil},
+		{"tokens.csv", "value,key\nhello\n", nil},
+		{"tokens.json", `[{"Value":"hello","Key":"k","Expire":"2030-01-02","Limit":2}]`, []bulkRow{
+			{Value: "hello", Key: "k", Expire: "2030-01-02", Limit: 2},
+		}},
+		{"tokens.txt", `  [{"value":"lower case"}]`, []bulkRow{{Value: "lower case"}}},
+		{"tokens.json", `{"Value":"not an array"}`, nil},
+		{"tokens.json", `[{"Value":"hello"}`, nil},
+	}
+	for _, test := range tests {
+		got, err := parseBulkFile(test.name, []byte(test.data))
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("parseBulkFile(%q, %q) accepted an invalid file", test.name, test.data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseBulkFile(%q, %q) = %v", test.name, test.data, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseBulkFile(%q, %q) = %+v, want %+v", test.name, test.data, got, test.want)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		str  string
+		want func(t time.Time) bool //Nil if the time is invalid
+	}{
+		{"72h", func(t time.Time) bool { return time.Until(t).Round(time.Hour) == 72*time.Hour }},
+		{"-1h", func(t time.Time) bool { return time.Until(t).Round(time.Hour) == -time.Hour }},
+		{"2031-05-06 07:08", func(t time.Time) bool { return t.Equal(time.Date(2031, 5, 6, 7, 8, 0, 0, time.Local)) }},
+		{"2031-05-06T07:08", func(t time.Time) bool { return t.Equal(time.Date(2031, 5, 6, 7, 8, 0, 0, time.Local)) }},
+		{"2031-05-06", func(t time.Time) bool { return t.Equal(time.Date(2031, 5, 6, 0, 0, 0, 0, time.Local)) }},
+		{"2031-05-06T07:08:09Z", func(t time.Time) bool { return t.Equal(time.Date(2031, 5, 6, 7, 8, 9, 0, time.UTC)) }},
+		{"", nil},
+		{"tomorrow", nil},
+		{"2031-13-01", nil},
+		{"06/05/2031", nil},
+	}
+	for _, test := range tests {
+		got, err := parseTime(test.str)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("parseTime(%q) accepted an invalid time", test.str)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseTime(%q) = %v", test.str, err)
+		} else if !test.want(got) {
+			t.Errorf("parseTime(%q) = %v", test.str, got)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+const cliUsage = `Commands:
+  tokens list                   List all of the tokens and their values
+  tokens add [options] value    Add a value and print its token; Use "tokens add -h" to see the options
+  tokens remove token           Remove a token
+  tokens show token             Show the value, metadata and stats of a token
+  db stats                      Show the statistics of the database
+  db compact                    Rewrite the database file to reclaim the free space; The bot must be stopped
+  db verify                     Check the consistency of the database
+  db genkey                     Print a random encryption key
+  db encrypt                    Encrypt the plaintext values and the values encrypted with the old keys with the current key`
+
+//Run a command line subcommand on the database without starting the bot
+func runCommand(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("invalid command\n%s", cliUsage)
+	}
+	switch args[0] + " " + args[1] {
+	case "tokens list":
+		return cliListTokens()
+	case "tokens add":
+		return cliAddToken(args[2:])
+	case "tokens remove":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: tokens remove token")
+		}
+		if err := store.RemoveKey(args[2]); err != nil {
+			return err
+		}
+		fmt.Println("Removed", args[2])
+		return nil
+	case "tokens show":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: tokens show token")
+		}
+		return cliShowToken(args[2])
+	case "db stats":
+		return cliDBStats()
+	case "db compact":
+		return cliCompactDB()
+	case "db verify":
+		return cliVerifyDB()
+	case "db genkey":
+		fmt.Println(generateKey())
+		return nil
+	case "db encrypt":
+		encrypted, ok := store.(*encryptedStore)
+		if !ok {
+			return fmt.Errorf("encryption is not enabled in the config")
+		}
+		changed, err := encrypted.Migrate()
+		fmt.Println("Encrypted", changed, "values and pool items")
+		return err
+	}
+	return fmt.Errorf("unknown command %s %s\n%s", args[0], args[1], cliUsage)
+}
+
+func cliListTokens() error {
+	keys, err := store.ListKeys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		value, err := store.ReadValue(key)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\t%s\n", key, strings.ReplaceAll(value, "\n", `\n`))
+	}
+	return nil
+}
+
+func cliAddToken(args []string) error {
+	set := flag.NewFlagSet("tokens add", flag.ContinueOnError)
+	var row bulkRow
+	set.StringVar(&row.Key, "key", "", "Custom token")
+	set.StringVar(&row.Expire, "expire", "", "Expiry time like 2006-01-02 15:04 or a duration from now like 72h")
+	set.IntVar(&row.Limit, "limit", 0, "Number of times that the value can be revealed")
+	if err := set.Parse(args); err != nil {
+		return err
+	}
+	row.Value = strings.Join(set.Args(), " ")
+	if row.Value == "-" { //Read the value from stdin
+		stdin, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		row.Value = strings.TrimSuffix(string(stdin), "\n")
+	}
+	value, err := row.toValue()
+	if err != nil {
+		return err
+	}
+	results, err := store.InsertValues([]bulkValue{value})
+	if err != nil {
+		return err
+	}
+	if results[0].Err != nil {
+		return results[0].Err
+	}
+	fmt.Println(results[0].Token)
+	return nil
+}
+
+func cliShowToken(token string) error {
+	value, err := store.ReadValue(token)
+	if err != nil {
+		return err
+	}
+	meta, err := store.ReadMeta(token)
+	if err != nil {
+		return err
+	}
+	report, err := store.ReadStats(token)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Value:", value)
+	if !meta.Created.IsZero() {
+		fmt.Println("Created:", meta.Created.Format(time.RFC3339))
+	}
+	if !meta.Expire.IsZero() {
+		fmt.Println("Expire:", meta.Expire.Format(time.RFC3339))
+	}
+	if meta.MaxUses > 0 {
+		fmt.Printf("Uses: %d of %d\n", meta.Uses, meta.MaxUses)
+	} else {
+		fmt.Println("Uses:", meta.Uses)
+	}
+	fmt.Println("Options:", meta.optionsText())
+	fmt.Println("Stats:", report.Total.String())
+	fmt.Println("Unique users:", report.UniqueUsers)
+	return nil
+}
+
+//The store as a fileStore for the db commands
+func cliFileStore() (fileStore, error) {
+	fs, ok := baseStore(store).(fileStore)
+	if !ok {
+		return nil, errNotSupported
+	}
+	return fs, nil
+}
+
+func cliDBStats() error {
+	fs, err := cliFileStore()
+	if err != nil {
+		return err
+	}
+	info, err := fs.Info()
+	if err != nil {
+		return err
+	}
+	fmt.Print(info)
+	return nil
+}
+
+func cliCompactDB() error {
+	fs, err := cliFileStore()
+	if err != nil {
+		return err
+	}
+	before, err := fs.Info()
+	if err != nil {
+		return err
+	}
+	if err = fs.Compact(); err != nil {
+		return err
+	}
+	after, err := fs.Info()
+	if err != nil {
+		return err
+	}
+	fmt.Print("Before:\n", before, "\nAfter:\n", after)
+	return nil
+}
+
+func cliVerifyDB() error {
+	fs, err := cliFileStore()
+	if err != nil {
+		return err
+	}
+	problems, err := fs.Verify()
+	if err != nil {
+		return err
+	}
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problems", len(problems))
+	}
+	fmt.Println("The database is OK")
+	return nil
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+//A command of the bot
+type command struct {
+	name        string
+	admin       bool   //Only the admins can use it
+	description string //Shown in the command list of Telegram
+	handler     func(message *tgbotapi.Message)
+}
+
+//The commands in the order which they are shown to the users
+//They are registered in init so the handlers can use the router without an initialization loop
+var commandList []command
+
+//The commands by their name
+var commands map[string]command
+
+//The states of the flows
+type addState struct {
+	Meta tokenMeta //The parsed options of /add; Passwords are only kept as their hash
+}
+type poolState struct {
+	Token string //Empty if it is a new pool
+}
+type importState struct {
+	Overwrite bool
+}
+type broadcastState struct {
+	Token string //Empty to send the message to all users
+}
+
+func init() {
+	commandList = []command{
+		{"start", false, "Start the bot", startCommand},
+		{"add", true, "Create a token for a text or link", addCommand},
+		{"set", true, "Change the options of a token", setCommand},
+		{"bulk", true, "Create tokens from a CSV or JSON file", bulkCommand},
+		{"pool", true, "Create a token which gives each user a unique item", poolCommand},
+		{"broadcast", true, "Send a message to the users", broadcastCommand},
+		{"ban", true, "Ban a user or list the banned users", banCommand},
+		{"unban", true, "Unban a user", unbanCommand},
+		{"remove", true, "Remove a token", removeCommand},
+		{"list", true, "List all of the tokens and values", listCommand},
+		{"export", true, "Get a backup of the database", exportCommand},
+		{"backup", true, "Get a snapshot of the database file", backupCommand},
+		{"import", true, "Restore a backup", importCommand},
+		{"stats", true, "Statistics of the tokens", statsCommand},
+		{"link", true, "Create a deep link with a source", linkCommand},
+		{"qr", true, "Get the QR code of a token", qrCommand},
+		{"language", false, "Change the language of the bot", languageCommand},
+		{"cancel", false, "Cancel the current command", cancelCommand},
+		{"id", false, "Get your ID", idCommand},
+		{"about", false, "About the bot", aboutCommand},
+	}
+	commands = make(map[string]command, len(commandList))
+	for _, cmd := range commandList {
+		commands[cmd.name] = cmd
+	}
+	flows = map[string]flowHandler{
+		"add":       addFlow,
+		"remove":    removeFlow,
+		"bulk":      bulkFlow,
+		"pool":      poolFlow,
+		"import":    importFlow,
+		"broadcast": broadcastFlow,
+	}
+}
+
+//Run the handler of a command; The admin commands are checked here
+func routeCommand(message *tgbotapi.Message) {
+	cmd, exists := commands[message.Command()]
+	if !exists {
+		botSend(tgbotapi.NewMessage(message.Chat.ID, tr(message.Chat.ID, "unknown_command")))
+		return
+	}
+	if cmd.admin && !checkInArray(message.From.ID, Config.Admins) { //Check admin
+		log.Println("Unauthorized access from id", message.From.ID, "and username", message.From.UserName, "and name", message.From.FirstName, message.From.LastName)
+		botSend(tgbotapi.NewMessage(message.Chat.ID, tr(message.Chat.ID, "not_admin")))
+		return
+	}
+	cmd.handler(message)
+}
+
+//Start a conversation and tell the admin what to send
+func askForMessage(message *tgbotapi.Message, flow string, state interface{}, msg tgbotapi.MessageConfig) {
+	if err := startConversation(message.From.ID, flow, state); err != nil {
+		msg.Text = "Error on saving the state: " + err.Error()
+		msg.ParseMode = ""
+	}
+	botSend(msg)
+}
+
+func startCommand(message *tgbotapi.Message) {
+	if strings.Contains(message.Text, " ") { //Check if bot is lunched from deeplink
+		token, source := splitPayload(strings.Split(message.Text, " ")[1]) //This gets the token and the source of it
+		processToken(token, source, *message.From, message.Chat.ID)
+		return
+	}
+	msg := tgbotapi.NewMessage(message.Chat.ID, "")
+	if !checkInArray(message.From.ID, Config.Admins) { //Check admin
+		msg.Text = tr(message.Chat.ID, "welcome")
+	} else {
+		msg.ReplyMarkup = adminMenu()
+		msg.Text = "Hello!\nYou are the admin of this bot.\nHere is a list of commands:\n\n/add : Use this command to add a link or text. This will later result in a \"token\". Share that token to users to let them receive the text or link. Options like /add delete=30s protect=on can be added.\n/set : Use /set token option=value to change the options of a token like expire, limit, delete, protect, password, approval and release\n/bulk : Create a lot of tokens from a CSV or JSON file\n/pool : Create a token which gives each user a unique item like a license key; Use /pool token to add items to it\n/broadcast : Send a message to all of the users; Use /broadcast token to only send it to the users who received the token\n/ban : Use /ban id reason or /ban @username reason to ban a user; /ban lists the banned users\n/unban : Unban a user\n/remove : Remove a token\n/list : Lists all of the tokens and values\n/export : Get a backup of the database\n/backup : Get a snapshot of the database file\n/import : Restore a backup; Use /import overwrite to clear the database before restoring\n/stats : Statistics of all tokens; Use /stats token to get the stats of one token\n/link : Use /link token source to create a deep link which tracks where the users came from\n/qr : Use /qr token or /qr token source to get a QR code of the deep link\n/cancel : Cancel the current command\n/id : Get the ID of anyone that sends it to bot. Can be used to define new admins.\n/about : Just a about screen"
+	}
+	botSend(msg)
+}
+
+func addCommand(message *tgbotapi.Message) {
+	msg := tgbotapi.NewMessage(message.Chat.ID, "")
+	var meta tokenMeta
+	if err := applyOptions(&meta, splitOptions(message.CommandArguments())); err != nil {
+		msg.Text = "Invalid options: " + escapeMarkdown(err.Error()) + "\n\n" + optionsHelp
+		msg.ParseMode = "markdown"
+		botSend(msg)
+		return
+	}
+	msg.Text = "Please send a text or a link to create a token for it"
+	askForMessage(message, "add", addState{Meta: meta}, msg)
+}
+
+//Admin sent the value of /add
+func addFlow(message *tgbotapi.Message, data json.RawMessage) error {
+	var state addState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	meta := state.Meta
+	token, err := store.InsertValue(message.Text, meta)
+	msg := tgbotapi.NewMessage(message.Chat.ID, "")
+	if err != nil {
+		msg.Text = "Error in inserting this string in database: " + err.Error()
+	} else {
+		scheduleRelease(token, meta)
+		msg.Text = "Successfully created the text in database!\nThe key is `" + token + "` .\nAlso you can use this link to let the users start the bot directly:\n" + escapeMarkdown(deepLink(token, "")) + "\nShare it with users.\n\nTo see where your users come from, add a source to the end of the link like " + escapeMarkdown(deepLink(token, "youtube")) + " or use `/link " + token + " source`. The sources are shown in /stats."
+		msg.ParseMode = "markdown"
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("QR code", "qr:"+token)))
+	}
+	botSend(msg)
+	return nil
+}
+
+func setCommand(message *tgbotapi.Message) {
+	msg := tgbotapi.NewMessage(message.Chat.ID, "")
+	msg.ParseMode = "markdown"
+	args := splitOptions(message.CommandArguments())
+	if len(args) == 0 {
+		msg.Text = "Use `/set token option=value ...` to change the options of a token or `/set token` to see them.\n\n" + optionsHelp
+	} else if !store.HasKey(args[0]) {
+		msg.Text = "This token does not exists."
+	} else {
+		var meta tokenMeta
+		err := store.UpdateMeta(args[0], func(m *tokenMeta) error {
+			if err := applyOptions(m, args[1:]); err != nil {
+				return err
+			}
+			meta = *m
+			return nil
+		})
+		if err != nil {
+			msg.Text = "Cannot set the options: " + escapeMarkdown(err.Error())
+		} else {
+			scheduleRelease(args[0], meta)
+			msg.Text = "Options of `" + args[0] + "`:\n`" + meta.optionsText() + "`"
+		}
+	}
+	botSend(msg)
+}
+
+func bulkCommand(message *tgbotapi.Message) {
+	msg := tgbotapi.NewMessage(message.Chat.ID, "Please send a CSV or JSON file to create the tokens.\n\nCSV files must have a header with these columns: `value`, `key`, `expire` and `limit`. Only `value` is mandatory.\nJSON files must be an array of objects with the same fields.\n\n`key` is a custom token, `expire` is a time like `2006-01-02 15:04` or a duration like `72h` and `limit` is the number of times that the value can be revealed.")
+	msg.ParseMode = "markdown"
+	askForMessage(message, "bulk", struct{}{}, msg)
+}
+
+//Admin sent the file of /bulk
+func bulkFlow(message *tgbotapi.Message, _ json.RawMessage) error {
+	if message.Document == nil {
+		botSend(tgbotapi.NewMessage(message.Chat.ID, "Please send a file. Use /bulk to try again."))
+		return nil
+	}
+	go processBulkFile(message.Chat.ID, message.Document)
+	return nil
+}
+
+func poolCommand(message *tgbotapi.Message) {
+	msg := tgbotapi.NewMessage(message.Chat.ID, "")
+	token := strings.TrimSpace(message.CommandArguments())
+	if token == "" {
+		msg.Text = "Please send the items of the pool, one item per line. You can also send them as a text file.\nEach user who passes the captcha gets one of the items and always gets the same item again."
+	} else if meta, err := store.ReadMeta(token); err != nil || !meta.Pool || !store.HasKey(token) {
+		msg.Text = "This token is not a pool."
+		botSend(msg)
+		return
+	} else {
+		msg.Text = "Please send the items to add to the pool, one item per line. You can also send them as a text file."
+	}
+	askForMessage(message, "pool", poolState{Token: token}, msg)
+}
+
+//Admin sent the items of /pool
+func poolFlow(message *tgbotapi.Message, data json.RawMessage) error {
+	var state poolState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	go processPoolItems(message, state.Token)
+	return nil
+}
+
+func broadcastCommand(message *tgbotapi.Message) {
+	token := strings.TrimSpace(message.CommandArguments())
+	if token != "" && !store.HasKey(token) {
+		botSend(tgbotapi.NewMessage(message.Chat.ID, "This token does not exists."))
+		return
+	}
+	msg := tgbotapi.NewMessage(message.Chat.ID, "Please send the message to broadcast to all of the users. It can be any kind of message.")
+	if token != "" {
+		msg.Text = "Please send the message to broadcast to the users who received " + token + ". It can be any kind of message."
+	}
+	askForMessage(message, "broadcast", broadcastState{Token: token}, msg)
+}
+
+//Admin sent the message of /broadcast
+func broadcastFlow(message *tgbotapi.Message, data json.RawMessage) error {
+	var state broadcastState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	go startBroadcast(message, state.Token)
+	return nil
+}
+
+func banCommand(message *tgbotapi.Message) {
+	msg := tgbotapi.NewMessage(message.Chat.ID, "")
+	args := strings.SplitN(strings.TrimSpace(message.CommandArguments()), " ", 2)
+	if args[0] == "" {
+		text, err := bansText()
+		if err != nil {
+			text = "Cannot read the bans: " + err.Error()
+		}
+		msg.Text = text
+	} else if id, err := findUserID(args[0]); err != nil {
+		msg.Text = err.Error()
+	} else if checkInArray(id, Config.Admins) {
+		msg.Text = "Admins cannot be banned."
+	} else {
+		b := ban{ID: id, By: message.From.ID}
+		if len(args) == 2 {
+			b.Reason = strings.TrimSpace(args[1])
+		}
+		if err = banUser(b); err != nil {
+			msg.Text = "Cannot ban the user: " + err.Error()
+		} else {
+			msg.Text = "Banned " + strconv.Itoa(id) + "."
+		}
+	}
+	botSend(msg)
+}
+
+func unbanCommand(message *tgbotapi.Message) {
+	msg := tgbotapi.NewMessage(message.Chat.ID, "")
+	if id, err := findUserID(strings.TrimSpace(message.CommandArguments())); err != nil {
+		msg.Text = err.Error() + "\nUse /unban id or /unban @username"
+	} else if err = store.DeleteRecord(banRecords, strconv.Itoa(id)); err != nil {
+		msg.Text = "Cannot unban the user: " + err.Error()
+	} else {
+		msg.Text = "Unbanned " + strconv.Itoa(id) + "."
+	}
+	botSend(msg)
+}
+
+func removeCommand(message *tgbotapi.Message) {
+	askForMessage(message, "remove", struct{}{}, tgbotapi.NewMessage(message.Chat.ID, "Please send the token to remove it from database"))
+}
+
+//Admin sent the token of /remove
+func removeFlow(message *tgbotapi.Message, _ json.RawMessage) error {
+	err := store.RemoveKey(message.Text)
+	if err == nil {
+		err = removeTokenRecords(message.Text)
+	}
+	msg := tgbotapi.NewMessage(message.Chat.ID, "")
+	if err != nil {
+		msg.Text = "Error in deleting this token from database: " + err.Error()
+	} else {
+		msg.Text = "Successfully deleted token `" + message.Text + "` from database."
+		msg.ParseMode = "markdown"
+	}
+	botSend(msg)
+	return nil
+}
+
+//Remove the pending approvals and the release subscriptions of a removed token
+//The release jobs of the token are left in the store; They ignore the tokens which do not exist
+func removeTokenRecords(token string) error {
+	for _, kind := range []string{approvalRecords, subscriptionRecords} { //Their keys are token:userID
+		var keys []string
+		err := store.ForEachRecord(kind, func(key string, _ []byte) error {
+			if strings.HasPrefix(key, token+":") {
+				keys = append(keys, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err = store.DeleteRecord(kind, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func listCommand(message *tgbotapi.Message) {
+	go func(id int64) { //Gather all of the links
+		msg := tgbotapi.NewMessage(id, "")
+		list, err := store.ListAllValues()
+		if err != nil {
+			msg.Text = "Error getting the list: " + err.Error()
+		} else {
+			if len(list) == 0 {
+				msg.Text = "The database is empty!"
+			} else {
+				var sb strings.Builder
+				for k, v := range list {
+					if len(v) > 100 {
+						v = escapeMarkdown(v[:100]) + " *...* "
+					} else {
+						v = escapeMarkdown(v)
+					}
+					sb.WriteString("`")
+					sb.WriteString(k)
+					sb.WriteString("`")
+					sb.WriteString(" : ")
+					sb.WriteString(v)
+					sb.WriteString("\n")
+				}
+				msg.Text = sb.String()
+				msg.ParseMode = "markdown"
+				msg.DisableWebPagePreview = true
+			}
+		}
+		botSend(msg)
+	}(message.Chat.ID)
+}
+
+func exportCommand(message *tgbotapi.Message) {
+	go func(id int64) {
+		var buf bytes.Buffer
+		if err := ExportDB(&buf); err != nil {
+			botSend(tgbotapi.NewMessage(id, "Error on exporting the database: "+err.Error()))
+			return
+		}
+		botSend(tgbotapi.NewDocumentUpload(id, tgbotapi.FileBytes{Bytes: buf.Bytes(), Name: exportFileName()}))
+	}(message.Chat.ID)
+}
+
+func backupCommand(message *tgbotapi.Message) {
+	go func(id int64) {
+		dir := Config.Backup.Dir
+		if dir == "" {
+			dir = os.TempDir()
+		}
+		name, err := BackupDB(dir)
+		if err != nil {
+			botSend(tgbotapi.NewMessage(id, "Error on creating the snapshot: "+err.Error()))
+			return
+		}
+		sendBackup(id, name)
+		if Config.Backup.Dir == "" { //Do not fill the temp directory
+			_ = os.Remove(name)
+		}
+	}(message.Chat.ID)
+}
+
+func importCommand(message *tgbotapi.Message) {
+	msg := tgbotapi.NewMessage(message.Chat.ID, "")
+	switch strings.TrimSpace(message.CommandArguments()) {
+	case "", "merge":
+		msg.Text = "Please send the backup file. The tokens which already exist will not be changed."
+		askForMessage(message, "import", importState{Overwrite: false}, msg)
+	case "overwrite":
+		msg.Text = "Please send the backup file. *Everything in the database will be deleted* and replaced with the backup."
+		msg.ParseMode = "markdown"
+		askForMessage(message, "import", importState{Overwrite: true}, msg)
+	default:
+		msg.Text = "Usage: /import or /import merge or /import overwrite"
+		botSend(msg)
+	}
+}
+
+//Admin sent the backup of /import
+func importFlow(message *tgbotapi.Message, data json.RawMessage) error {
+	var state importState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	if message.Document == nil {
+		botSend(tgbotapi.NewMessage(message.Chat.ID, "Please send a file. Use /import to try again."))
+		return nil
+	}
+	go processImportFile(message.Chat.ID, message.Document, state.Overwrite)
+	return nil
+}
+
+func statsCommand(message *tgbotapi.Message) {
+	go func(id int64, token string) {
+		msg := tgbotapi.NewMessage(id, "")
+		text, err := statsText(token)
+		if err != nil {
+			msg.Text = "Error getting the stats: " + err.Error()
+		} else {
+			msg.Text = text
+			msg.ParseMode = "markdown"
+		}
+		botSend(msg)
+	}(message.Chat.ID, strings.TrimSpace(message.CommandArguments()))
+}
+
+func linkCommand(message *tgbotapi.Message) {
+	msg := tgbotapi.NewMessage(message.Chat.ID, "")
+	args := strings.Fields(message.CommandArguments())
+	if len(args) != 2 {
+		msg.Text = "Usage: /link token source\nFor example /link abcdEFGH youtube"
+	} else if !store.HasKey(args[0]) {
+		msg.Text = "The token you provided is in valid or does not exists."
+	} else if !validSource(args[1]) {
+		msg.Text = "The source can only contain letters, numbers and underscore and must be at most " + strconv.Itoa(maxSourceLength) + " characters."
+	} else {
+		msg.Text = "Here is the link for source " + args[1] + ":\n" + deepLink(args[0], args[1])
+		msg.DisableWebPagePreview = true
+	}
+	botSend(msg)
+}
+
+func qrCommand(message *tgbotapi.Message) {
+	msg := tgbotapi.NewMessage(message.Chat.ID, "")
+	args := strings.Fields(message.CommandArguments())
+	if len(args) == 0 || len(args) > 2 {
+		msg.Text = "Usage: /qr token or /qr token source"
+	} else if !store.HasKey(args[0]) {
+		msg.Text = "The token you provided is in valid or does not exists."
+	} else if len(args) == 2 && !validSource(args[1]) {
+		msg.Text = "The source can only contain letters, numbers and underscore and must be at most " + strconv.Itoa(maxSourceLength) + " characters."
+	} else {
+		args = append(args, "")
+		go sendQRCode(message.Chat.ID, args[0], args[1])
+		return
+	}
+	botSend(msg)
+}
+
+func cancelCommand(message *tgbotapi.Message) {
+	CaptchaToCheck.mux.Lock()
+	delete(CaptchaToCheck.CaptchaToCheck, message.From.ID)
+	CaptchaToCheck.mux.Unlock()
+	cancelPassword(message.From.ID)
+	endConversation(message.From.ID)
+	botSend(tgbotapi.NewMessage(message.Chat.ID, tr(message.Chat.ID, "cancelled")))
+}
+
+func aboutCommand(message *tgbotapi.Message) {
+	botSend(tgbotapi.NewMessage(message.Chat.ID, "Made by Hirbod Behnam\nGolang\nSource code at https://github.com/HirbodBehnam/CaptchaBot\nBackend version "+Version))
+}
+
+//Send the id to anyone
+func idCommand(message *tgbotapi.Message) {
+	botSend(tgbotapi.NewMessage(message.Chat.ID, strconv.FormatInt(int64(message.From.ID), 10)))
+}
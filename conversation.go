@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+//Kind of the records of the conversations; Their keys are the user IDs
+const conversationRecords = "conversation"
+
+const defaultConversationTimeout = 10 * time.Minute
+
+//A flow which waits for the next message of a user, like /add which waits for the value
+type conversation struct {
+	Flow    string
+	State   json.RawMessage //The state of the flow; Each flow has its own type
+	Expires time.Time
+}
+
+//Handle the next message of a conversation; state is what the flow was started with
+//The conversation is ended before the handler runs, so the handler can start another step
+type flowHandler func(message *tgbotapi.Message, state json.RawMessage) error
+
+//The flows by their name; They are registered in init with the commands
+var flows map[string]flowHandler
+
+//Wait for the next message of a user and give it to the flow; state is saved as JSON
+func startConversation(userID int, flow string, state interface{}) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	timeout := time.Duration(Config.ConversationTimeout) * time.Minute
+	if timeout <= 0 {
+		timeout = defaultConversationTimeout
+	}
+	return putJSONRecord(conversationRecords, strconv.Itoa(userID), conversation{Flow: flow, State: b, Expires: time.Now().Add(timeout)})
+}
+
+//Forget the conversation of a user
+func endConversation(userID int) {
+	if err := store.DeleteRecord(conversationRecords, strconv.Itoa(userID)); err != nil {
+		log.Println("Cannot remove the conversation:", err.Error())
+	}
+}
+
+//Give a message to the conversation of its user; Returns false if the user has no conversation
+func continueConversation(message *tgbotapi.Message) bool {
+	var conv conversation
+	err := takeJSONRecord(conversationRecords, strconv.Itoa(message.From.ID), &conv)
+	if err == errRecordNotFound {
+		return false
+	}
+	if err != nil {
+		log.Println("Cannot read the conversation:", err.Error())
+		return false
+	}
+	if time.Now().After(conv.Expires) { //The message may be something else like a token so it is handled as usual
+		botSend(tgbotapi.NewMessage(message.Chat.ID, tr(message.Chat.ID, "conversation_expired", conv.Flow)))
+		return false
+	}
+	handler, exists := flows[conv.Flow]
+	if !exists {
+		log.Println("Unknown conversation flow:", conv.Flow)
+		return false
+	}
+	//Conversations survive restarts so the admins may have changed since the command; Flows which are not commands are for admins
+	if cmd, isCommand := commands[conv.Flow]; (!isCommand || cmd.admin) && !checkInArray(message.From.ID, Config.Admins) {
+		log.Println("Unauthorized /"+conv.Flow, "conversation from id", message.From.ID, "and username", message.From.UserName)
+		return false
+	}
+	if err = handler(message, conv.State); err != nil {
+		botSend(tgbotapi.NewMessage(message.Chat.ID, "Error: "+err.Error()))
+	}
+	return true
+}
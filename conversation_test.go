@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+func TestConversationChecksAdmins(t *testing.T) {
+	oldStore, oldAdmins := store, Config.Admins
+	t.Cleanup(func() { store, Config.Admins = oldStore, oldAdmins })
+	store = newMemoryStore()
+	Config.Admins = []int{1}
+	called := 0
+	flows["test"] = func(*tgbotapi.Message, json.RawMessage) error {
+		called++
+		return nil
+	}
+	defer delete(flows, "test")
+	message := func(from int) *tgbotapi.Message {
+		return &tgbotapi.Message{From: &tgbotapi.User{ID: from}, Chat: &tgbotapi.Chat{ID: int64(from)}, Text: "value"}
+	}
+
+	if err := startConversation(1, "test", nil); err != nil {
+		t.Fatal(err)
+	}
+	if !continueConversation(message(1)) || called != 1 {
+		t.Fatalf("the flow of an admin did not run")
+	}
+
+	if err := startConversation(2, "test", nil); err != nil { //An admin who is removed from the config
+		t.Fatal(err)
+	}
+	if continueConversation(message(2)) || called != 1 {
+		t.Fatalf("the flow of a user who is not an admin ran")
+	}
+}
@@ -1,78 +1,164 @@
 package main
 
 import (
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"github.com/boltdb/bolt"
 	"log"
-	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
-const alphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+//The metadata of tokens are saved as JSON in this bucket with the same key as the "DB" bucket
+const metaBucket = "Meta"
 
-var db *bolt.DB
+//Every pool has a bucket under this bucket with these keys:
+// items : A bucket of item numbers starting from 1 to the items; The sequence of it is the last item number
+// claims : A bucket of user IDs to the item number they got
+// next : The number of the next item to give
+const poolsBucket = "Pools"
+
+//Records are saved in a bucket of their kind in this bucket
+const recordsBucket = "Records"
+
+//Scheduled jobs are saved in this bucket as JSON. Keys are the time of the job and a sequence so they are sorted by time
+const jobsBucket = "Jobs"
+
+//The default store. Values are saved in the "DB" bucket
+type boltStore struct {
+	db *bolt.DB
+}
 
 //https://zupzup.org/boltdb-example/
 // Loads the database; Creates one if does not exist
-func LoadDB(dataBaseName string) error {
-	var err error
-	db, err = bolt.Open(dataBaseName, 0600, nil)
+func openBoltStore(dataBaseName string) (*boltStore, error) {
+	db, err := bolt.Open(dataBaseName, 0600, &bolt.Options{Timeout: time.Second}) //Do not wait forever if another bot is using it
 	if err != nil {
-		return fmt.Errorf("could not open db, %v", err)
+		return nil, fmt.Errorf("could not open db, %v", err)
 	}
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("DB"))
-		if err != nil {
-			return fmt.Errorf("could not create root bucket: %v", err)
-		}
-		return nil
-	})
+	err = db.Update(createBuckets)
 	if err != nil {
-		return fmt.Errorf("could not set up buckets, %v", err)
+		_ = db.Close()
+		return nil, fmt.Errorf("could not set up buckets, %v", err)
 	}
 	log.Println("DB Setup Done")
+	return &boltStore{db}, nil
+}
+
+//Create the buckets which the bot needs if they do not exist
+func createBuckets(tx *bolt.Tx) error {
+	for _, bucket := range []string{"DB", metaBucket, statsBucket, poolsBucket, jobsBucket, recordsBucket} {
+		_, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return fmt.Errorf("could not create %s bucket: %v", bucket, err)
+		}
+	}
 	return nil
 }
 
-func CloseDB() {
-	_ = db.Close()
+func (s *boltStore) Close() error {
+	return s.db.Close()
 }
 
 //Inserts a link into the database
 //Returns the ID for the link to be shared later
-func InsertValue(Value string) (string, error) {
-	for {
-		key := generateRandomStringAsByte()
-		hasValue := false
-		//Check if the random exists in database
-		err := db.View(func(tx *bolt.Tx) error {
-			check := tx.Bucket([]byte("DB")).Get(key)
-			hasValue = check != nil
-			return nil
-		})
-		if err != nil {
-			return "", err
-		}
-		if !hasValue { //In this case we save the string into database
-			err = db.Update(func(tx *bolt.Tx) error {
-				err = tx.Bucket([]byte("DB")).Put(key, []byte(Value))
-				if err != nil {
-					return fmt.Errorf("could not read db: %v", err)
-				}
-				return nil
-			})
-			if err != nil {
-				return "", err
+func (s *boltStore) InsertValue(value string, meta tokenMeta) (string, error) {
+	var key string
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		key, err = insertValue(tx, "", value, meta)
+		return err
+	})
+	return key, err
+}
+
+//Inserts a value with its metadata in a transaction; If key is empty a random key is generated
+func insertValue(tx *bolt.Tx, key, value string, meta tokenMeta) (string, error) {
+	bucket := tx.Bucket([]byte("DB"))
+	if key == "" {
+		for { //Generate randoms until we find one which does not exist
+			key = generateRandomString()
+			if bucket.Get([]byte(key)) == nil {
+				break
 			}
-			return string(key), nil
+		}
+	} else if bucket.Get([]byte(key)) != nil {
+		return "", fmt.Errorf("the key %s already exists", key)
+	}
+	if err := bucket.Put([]byte(key), []byte(value)); err != nil {
+		return "", fmt.Errorf("could not write db: %v", err)
+	}
+	meta.Created = time.Now()
+	return key, putMeta(tx, key, meta)
+}
+
+func putMeta(tx *bolt.Tx, key string, meta tokenMeta) error {
+	v, _ := json.Marshal(meta)
+	if err := tx.Bucket([]byte(metaBucket)).Put([]byte(key), v); err != nil {
+		return fmt.Errorf("could not write metadata: %v", err)
+	}
+	return nil
+}
+
+//Read the metadata of a token in a transaction; Tokens without metadata have an empty one
+func getMeta(tx *bolt.Tx, key string) (tokenMeta, error) {
+	var meta tokenMeta
+	if v := tx.Bucket([]byte(metaBucket)).Get([]byte(key)); v != nil {
+		if err := json.Unmarshal(v, &meta); err != nil {
+			return meta, fmt.Errorf("corrupted metadata: %v", err)
 		}
 	}
+	return meta, nil
+}
+
+//Read the metadata of a token
+func (s *boltStore) ReadMeta(Key string) (tokenMeta, error) {
+	var meta tokenMeta
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		meta, err = getMeta(tx, Key)
+		return err
+	})
+	return meta, err
+}
+
+func (s *boltStore) UpdateMeta(Key string, update func(meta *tokenMeta) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("DB")).Get([]byte(Key)) == nil {
+			return fmt.Errorf("this token does not exits")
+		}
+		meta, err := getMeta(tx, Key)
+		if err != nil {
+			return err
+		}
+		if err = update(&meta); err != nil {
+			return err
+		}
+		return putMeta(tx, Key, meta)
+	})
+}
+
+//Insert a lot of values in one transaction. Errors of each value are in its result and do not stop the others
+func (s *boltStore) InsertValues(values []bulkValue) ([]bulkResult, error) {
+	results := make([]bulkResult, len(values))
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for i, value := range values {
+			results[i].Token, results[i].Err = insertValue(tx, value.Key, value.Value, value.Meta)
+		}
+		return nil
+	})
+	return results, err
 }
 
 //Check if a key exists; On errors return false as well
-func HasKey(Key string) bool {
+func (s *boltStore) HasKey(Key string) bool {
 	hasValue := false
 	//Check if the random exists in database
-	_ = db.View(func(tx *bolt.Tx) error {
+	_ = s.db.View(func(tx *bolt.Tx) error {
 		check := tx.Bucket([]byte("DB")).Get([]byte(Key))
 		hasValue = check != nil
 		return nil
@@ -81,30 +167,32 @@ func HasKey(Key string) bool {
 }
 
 //Remove a key from the database
-func RemoveKey(Key string) error {
-	if !HasKey(Key) {
+func (s *boltStore) RemoveKey(Key string) error {
+	if !s.HasKey(Key) {
 		return fmt.Errorf("this token does not exits")
 	}
-	err := db.Update(func(tx *bolt.Tx) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
 		err := tx.Bucket([]byte("DB")).Delete([]byte(Key))
 		if err != nil {
 			return fmt.Errorf("could not delete key: %v", err)
 		}
-		return nil
+		if err = tx.Bucket([]byte(metaBucket)).Delete([]byte(Key)); err != nil {
+			return fmt.Errorf("could not delete metadata: %v", err)
+		}
+		if err = tx.Bucket([]byte(poolsBucket)).DeleteBucket([]byte(Key)); err != nil && err != bolt.ErrBucketNotFound {
+			return fmt.Errorf("could not delete pool: %v", err)
+		}
+		return removeStats(tx, Key)
 	})
 	return err
 }
 
 //List all of the values
-func ListAllValues() (map[string]string, error) {
+func (s *boltStore) ListAllValues() (map[string]string, error) {
 	m := make(map[string]string)
-	err := db.View(func(tx *bolt.Tx) error {
+	err := s.db.View(func(tx *bolt.Tx) error {
 		err := tx.Bucket([]byte("DB")).ForEach(func(k, v []byte) error {
-			if len(v) > 100 {
-				m[string(k)] = escapeMarkdown(string(v[:100])) + " *...* "
-			} else {
-				m[string(k)] = escapeMarkdown(string(v))
-			}
+			m[string(k)] = string(v)
 			return nil
 		})
 		return err
@@ -112,13 +200,26 @@ func ListAllValues() (map[string]string, error) {
 	return m, err
 }
 
+//Get all of the tokens sorted
+func (s *boltStore) ListKeys() ([]string, error) {
+	var keys []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("DB")).ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
 //Read the value from database
-func ReadValue(Key string) (string, error) {
+func (s *boltStore) ReadValue(Key string) (string, error) {
 	var res string
-	err := db.View(func(tx *bolt.Tx) error {
+	err := s.db.View(func(tx *bolt.Tx) error {
 		check := tx.Bucket([]byte("DB")).Get([]byte(Key))
 		if check == nil {
-			return fmt.Errorf("Cannot find value for " + Key)
+			return fmt.Errorf("cannot find value for %s", Key)
 		}
 		res = string(check)
 		return nil
@@ -129,11 +230,372 @@ func ReadValue(Key string) (string, error) {
 	return res, nil
 }
 
-//Keys are 8 letter long
-func generateRandomStringAsByte() []byte {
-	s := ""
-	for i := 0; i < 8; i++ {
-		s += string(alphabet[rand.Int31n(52)])
+//Replace the value of a token
+func (s *boltStore) UpdateValue(Key, Value string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("DB"))
+		if bucket.Get([]byte(Key)) == nil {
+			return fmt.Errorf("this token does not exits")
+		}
+		return bucket.Put([]byte(Key), []byte(Value))
+	})
+}
+
+//Read the value of a token to give it to a user; The usage limit and the expiry are checked and the usage is counted
+func (s *boltStore) RevealValue(Key string) (string, error) {
+	var res string
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		check := tx.Bucket([]byte("DB")).Get([]byte(Key))
+		if check == nil {
+			return fmt.Errorf("cannot find value for %s", Key)
+		}
+		meta, err := getMeta(tx, Key)
+		if err != nil {
+			return err
+		}
+		if err = meta.check(); err != nil {
+			return err
+		}
+		meta.Uses++
+		res = string(check)
+		return putMeta(tx, Key, meta)
+	})
+	return res, err
+}
+
+func (s *boltStore) AddPoolItems(token string, items []string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		pool, err := tx.Bucket([]byte(poolsBucket)).CreateBucketIfNotExists([]byte(token))
+		if err != nil {
+			return fmt.Errorf("could not create pool: %v", err)
+		}
+		bucket, err := pool.CreateBucketIfNotExists([]byte("items"))
+		if err != nil {
+			return fmt.Errorf("could not create pool: %v", err)
+		}
+		for _, item := range items {
+			id, _ := bucket.NextSequence()
+			if err = bucket.Put(itob(id), []byte(item)); err != nil {
+				return fmt.Errorf("could not write pool: %v", err)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) ClaimPoolItem(token string, user int) (item string, remaining int, claimed bool, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		pool := tx.Bucket([]byte(poolsBucket)).Bucket([]byte(token))
+		if pool == nil {
+			return errPoolEmpty
+		}
+		items := pool.Bucket([]byte("items"))
+		claims, err := pool.CreateBucketIfNotExists([]byte("claims"))
+		if err != nil {
+			return fmt.Errorf("could not write pool: %v", err)
+		}
+		next := uint64(1)
+		if v := pool.Get([]byte("next")); v != nil {
+			next = btoi(v)
+		}
+		remaining = int(items.Sequence() - next + 1)
+		userKey := []byte(strconv.Itoa(user))
+		if id := claims.Get(userKey); id != nil { //User has already got an item
+			item = string(items.Get(id))
+			return nil
+		}
+		meta, err := getMeta(tx, token)
+		if err != nil {
+			return err
+		}
+		if err = meta.check(); err != nil {
+			return err
+		}
+		if next > items.Sequence() {
+			return errPoolEmpty
+		}
+		item = string(items.Get(itob(next)))
+		remaining--
+		claimed = true
+		meta.Uses++
+		if err = claims.Put(userKey, itob(next)); err != nil {
+			return fmt.Errorf("could not write pool: %v", err)
+		}
+		if err = pool.Put([]byte("next"), itob(next+1)); err != nil {
+			return fmt.Errorf("could not write pool: %v", err)
+		}
+		return putMeta(tx, token, meta)
+	})
+	return
+}
+
+func (s *boltStore) RewritePoolItems(token string, rewrite func(item string) (string, error)) (int, error) {
+	changed := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		changed = 0
+		pool := tx.Bucket([]byte(poolsBucket)).Bucket([]byte(token))
+		if pool == nil || pool.Bucket([]byte("items")) == nil {
+			return nil
+		}
+		items := pool.Bucket([]byte("items"))
+		updates := make(map[string]string)
+		err := items.ForEach(func(k, v []byte) error {
+			item, err := rewrite(string(v))
+			if err == nil && item != string(v) {
+				updates[string(k)] = item
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for k, item := range updates { //Buckets must not be changed while iterating them
+			if err = items.Put([]byte(k), []byte(item)); err != nil {
+				return fmt.Errorf("could not write pool: %v", err)
+			}
+		}
+		changed = len(updates)
+		return nil
+	})
+	return changed, err
+}
+
+func (s *boltStore) PoolStatus(token string) (total, claimed int, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		pool := tx.Bucket([]byte(poolsBucket)).Bucket([]byte(token))
+		if pool == nil {
+			return nil
+		}
+		total = int(pool.Bucket([]byte("items")).Sequence())
+		if v := pool.Get([]byte("next")); v != nil {
+			claimed = int(btoi(v)) - 1
+		}
+		return nil
+	})
+	return
+}
+
+func (s *boltStore) AddJob(job scheduledJob) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(jobsBucket))
+		seq, _ := bucket.NextSequence()
+		v, _ := json.Marshal(job)
+		return bucket.Put(append(itob(uint64(job.At.UnixNano())), itob(seq)...), v)
+	})
+}
+
+func (s *boltStore) DueJobs(now time.Time) ([]scheduledJob, error) {
+	var jobs []scheduledJob
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(jobsBucket)).Cursor()
+		for k, v := c.First(); k != nil && btoi(k[:8]) <= uint64(now.UnixNano()); k, v = c.First() {
+			var job scheduledJob
+			if err := json.Unmarshal(v, &job); err != nil {
+				log.Println("Removing corrupted job:", err.Error())
+			} else {
+				jobs = append(jobs, job)
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return jobs, err
+}
+
+func (s *boltStore) PutRecord(kind, key string, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket([]byte(recordsBucket)).CreateBucketIfNotExists([]byte(kind))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), value)
+	})
+}
+
+func (s *boltStore) GetRecord(kind, key string) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(recordsBucket)).Bucket([]byte(kind))
+		if bucket == nil {
+			return errRecordNotFound
+		}
+		v := bucket.Get([]byte(key))
+		if v == nil {
+			return errRecordNotFound
+		}
+		value = append([]byte(nil), v...)
+		return nil
+	})
+	return value, err
+}
+
+func (s *boltStore) UpdateRecord(kind, key string, update func(value []byte) ([]byte, error)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket([]byte(recordsBucket)).CreateBucketIfNotExists([]byte(kind))
+		if err != nil {
+			return err
+		}
+		var value []byte
+		if v := bucket.Get([]byte(key)); v != nil {
+			value = append([]byte{}, v...)
+		}
+		if value, err = update(value); err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), value)
+	})
+}
+
+func (s *boltStore) TakeRecord(kind, key string) ([]byte, error) {
+	var value []byte
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(recordsBucket)).Bucket([]byte(kind))
+		if bucket == nil {
+			return errRecordNotFound
+		}
+		v := bucket.Get([]byte(key))
+		if v == nil {
+			return errRecordNotFound
+		}
+		value = append([]byte(nil), v...)
+		return bucket.Delete([]byte(key))
+	})
+	return value, err
+}
+
+func (s *boltStore) DeleteRecord(kind, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(recordsBucket)).Bucket([]byte(kind))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(key))
+	})
+}
+
+func (s *boltStore) ForEachRecord(kind string, f func(key string, value []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(recordsBucket)).Bucket([]byte(kind))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			return f(string(k), v)
+		})
+	})
+}
+
+//Convert a number to a big endian key so they are sorted
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func btoi(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
+
+//Write a consistent copy of the database while the bot is running
+func (s *boltStore) Snapshot(name string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
 	}
-	return []byte(s)
+	err = s.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(f)
+		return err
+	})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+//Copy the database into a new file and replace the old file with it
+func (s *boltStore) Compact() error {
+	path := s.db.Path()
+	compacted, err := bolt.Open(path+".compact", 0600, nil)
+	if err != nil {
+		return err
+	}
+	err = s.db.View(func(src *bolt.Tx) error {
+		return compacted.Update(func(dst *bolt.Tx) error {
+			return src.ForEach(func(name []byte, b *bolt.Bucket) error {
+				copied, err := dst.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(copied, b)
+			})
+		})
+	})
+	if closeErr := compacted.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path + ".compact")
+		return fmt.Errorf("could not compact the database: %v", err)
+	}
+	_ = s.db.Close()
+	if err = os.Rename(path+".compact", path); err != nil {
+		return err
+	}
+	reopened, err := openBoltStore(path)
+	if err != nil {
+		return err
+	}
+	s.db = reopened.db
+	return nil
+}
+
+func copyBucket(dst, src *bolt.Bucket) error {
+	dst.FillPercent = 1 //Keys are copied in order so the pages can be full
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		child, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(child, src.Bucket(k))
+	})
+}
+
+//Check the consistency of the database
+func (s *boltStore) Verify() ([]string, error) {
+	var problems []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			problems = append(problems, "Corruption: "+err.Error())
+		}
+		//Every token must have a readable metadata
+		return tx.Bucket([]byte("DB")).ForEach(func(k, _ []byte) error {
+			if _, err := getMeta(tx, string(k)); err != nil {
+				problems = append(problems, fmt.Sprintf("Token %s: %v", k, err))
+			}
+			return nil
+		})
+	})
+	return problems, err
+}
+
+func (s *boltStore) Info() (string, error) {
+	info, err := os.Stat(s.db.Path())
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("File: %s\nSize: %d bytes\n", s.db.Path(), info.Size()))
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			stats := b.Stats()
+			sb.WriteString(fmt.Sprintf("Bucket %s: %d keys, %d buckets, %d pages\n", name, stats.KeyN, stats.BucketN-1, stats.BranchPageN+stats.LeafPageN))
+			return nil
+		})
+	})
+	return sb.String(), err
 }
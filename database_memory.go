@@ -0,0 +1,411 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+//A store which keeps everything in memory; Everything is lost when the bot stops. Useful for testing
+type memoryStore struct {
+	mux     sync.Mutex
+	values  map[string]string
+	metas   map[string]tokenMeta
+	stats   map[string]*memoryStats
+	pools   map[string]*memoryPool
+	jobs    []scheduledJob
+	records map[string]map[string][]byte //Kind, key and the value of the records
+}
+
+type memoryPool struct {
+	items  []string
+	claims map[int]int //User IDs to the index of their items
+}
+
+type memoryStats struct {
+	total   tokenStats
+	daily   map[string]tokenStats
+	sources map[string]tokenStats
+	users   map[int]time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		values:  make(map[string]string),
+		metas:   make(map[string]tokenMeta),
+		stats:   make(map[string]*memoryStats),
+		pools:   make(map[string]*memoryPool),
+		records: make(map[string]map[string][]byte),
+	}
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+//Must be called with the mutex locked
+func (s *memoryStore) insertValue(key, value string, meta tokenMeta) (string, error) {
+	if key == "" {
+		for { //Generate randoms until we find one which does not exist
+			key = generateRandomString()
+			if _, exists := s.values[key]; !exists {
+				break
+			}
+		}
+	} else if _, exists := s.values[key]; exists {
+		return "", fmt.Errorf("the key %s already exists", key)
+	}
+	meta.Created = time.Now()
+	s.values[key] = value
+	s.metas[key] = meta
+	return key, nil
+}
+
+func (s *memoryStore) InsertValue(value string, meta tokenMeta) (string, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.insertValue("", value, meta)
+}
+
+func (s *memoryStore) InsertValues(values []bulkValue) ([]bulkResult, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	results := make([]bulkResult, len(values))
+	for i, value := range values {
+		results[i].Token, results[i].Err = s.insertValue(value.Key, value.Value, value.Meta)
+	}
+	return results, nil
+}
+
+func (s *memoryStore) HasKey(key string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	_, exists := s.values[key]
+	return exists
+}
+
+func (s *memoryStore) RemoveKey(key string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, exists := s.values[key]; !exists {
+		return fmt.Errorf("this token does not exits")
+	}
+	delete(s.values, key)
+	delete(s.metas, key)
+	delete(s.stats, key)
+	delete(s.pools, key)
+	return nil
+}
+
+func (s *memoryStore) ListAllValues() (map[string]string, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	m := make(map[string]string, len(s.values))
+	for k, v := range s.values {
+		m[k] = v
+	}
+	return m, nil
+}
+
+func (s *memoryStore) ListKeys() ([]string, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	keys := make([]string, 0, len(s.values))
+	for k := range s.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *memoryStore) ReadValue(key string) (string, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	value, exists := s.values[key]
+	if !exists {
+		return "", fmt.Errorf("cannot find value for %s", key)
+	}
+	return value, nil
+}
+
+func (s *memoryStore) UpdateValue(key, value string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, exists := s.values[key]; !exists {
+		return fmt.Errorf("this token does not exits")
+	}
+	s.values[key] = value
+	return nil
+}
+
+func (s *memoryStore) ReadMeta(key string) (tokenMeta, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.metas[key], nil
+}
+
+func (s *memoryStore) UpdateMeta(key string, update func(meta *tokenMeta) error) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, exists := s.values[key]; !exists {
+		return fmt.Errorf("this token does not exits")
+	}
+	meta := s.metas[key]
+	if err := update(&meta); err != nil {
+		return err
+	}
+	s.metas[key] = meta
+	return nil
+}
+
+func (s *memoryStore) RevealValue(key string) (string, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	value, exists := s.values[key]
+	if !exists {
+		return "", fmt.Errorf("cannot find value for %s", key)
+	}
+	meta := s.metas[key]
+	if err := meta.check(); err != nil {
+		return "", err
+	}
+	meta.Uses++
+	s.metas[key] = meta
+	return value, nil
+}
+
+func (s *memoryStore) AddPoolItems(token string, items []string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	pool := s.pools[token]
+	if pool == nil {
+		pool = &memoryPool{claims: make(map[int]int)}
+		s.pools[token] = pool
+	}
+	pool.items = append(pool.items, items...)
+	return nil
+}
+
+func (s *memoryStore) ClaimPoolItem(token string, user int) (string, int, bool, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	pool := s.pools[token]
+	if pool == nil {
+		return "", 0, false, errPoolEmpty
+	}
+	remaining := len(pool.items) - len(pool.claims)
+	if i, exists := pool.claims[user]; exists { //User has already got an item
+		return pool.items[i], remaining, false, nil
+	}
+	meta := s.metas[token]
+	if err := meta.check(); err != nil {
+		return "", remaining, false, err
+	}
+	if remaining == 0 {
+		return "", 0, false, errPoolEmpty
+	}
+	i := len(pool.claims)
+	pool.claims[user] = i
+	meta.Uses++
+	s.metas[token] = meta
+	return pool.items[i], remaining - 1, true, nil
+}
+
+func (s *memoryStore) RewritePoolItems(token string, rewrite func(item string) (string, error)) (int, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	pool := s.pools[token]
+	if pool == nil {
+		return 0, nil
+	}
+	items := make([]string, len(pool.items))
+	changed := 0
+	for i, item := range pool.items {
+		rewritten, err := rewrite(item)
+		if err != nil {
+			return 0, err
+		}
+		if rewritten != item {
+			changed++
+		}
+		items[i] = rewritten
+	}
+	pool.items = items
+	return changed, nil
+}
+
+func (s *memoryStore) PoolStatus(token string) (int, int, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	pool := s.pools[token]
+	if pool == nil {
+		return 0, 0, nil
+	}
+	return len(pool.items), len(pool.claims), nil
+}
+
+func (s *memoryStore) AddJob(job scheduledJob) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.jobs = append(s.jobs, job)
+	return nil
+}
+
+func (s *memoryStore) DueJobs(now time.Time) ([]scheduledJob, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var due []scheduledJob
+	remaining := s.jobs[:0]
+	for _, job := range s.jobs {
+		if job.At.After(now) {
+			remaining = append(remaining, job)
+		} else {
+			due = append(due, job)
+		}
+	}
+	s.jobs = remaining
+	return due, nil
+}
+
+func (s *memoryStore) PutRecord(kind, key string, value []byte) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.records[kind] == nil {
+		s.records[kind] = make(map[string][]byte)
+	}
+	s.records[kind][key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (s *memoryStore) GetRecord(kind, key string) ([]byte, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	value, exists := s.records[kind][key]
+	if !exists {
+		return nil, errRecordNotFound
+	}
+	return append([]byte(nil), value...), nil
+}
+
+func (s *memoryStore) UpdateRecord(kind, key string, update func(value []byte) ([]byte, error)) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var value []byte
+	if v, exists := s.records[kind][key]; exists {
+		value = append([]byte{}, v...)
+	}
+	value, err := update(value)
+	if err != nil {
+		return err
+	}
+	if s.records[kind] == nil {
+		s.records[kind] = make(map[string][]byte)
+	}
+	s.records[kind][key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (s *memoryStore) TakeRecord(kind, key string) ([]byte, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	value, exists := s.records[kind][key]
+	if !exists {
+		return nil, errRecordNotFound
+	}
+	delete(s.records[kind], key)
+	return value, nil
+}
+
+func (s *memoryStore) DeleteRecord(kind, key string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.records[kind], key)
+	return nil
+}
+
+func (s *memoryStore) ForEachRecord(kind string, f func(key string, value []byte) error) error {
+	s.mux.Lock()
+	records := make(map[string][]byte, len(s.records[kind]))
+	for key, value := range s.records[kind] {
+		records[key] = value
+	}
+	s.mux.Unlock()
+	for key, value := range records {
+		if err := f(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) RecordStat(token, source string, user int, event statEvent) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, exists := s.values[token]; !exists {
+		return nil
+	}
+	stats := s.stats[token]
+	if stats == nil {
+		stats = &memoryStats{
+			daily:   make(map[string]tokenStats),
+			sources: make(map[string]tokenStats),
+			users:   make(map[int]time.Time),
+		}
+		s.stats[token] = stats
+	}
+	if source == "" {
+		source = directSource
+	}
+	stats.total.add(event)
+	day := time.Now().Format(dayFormat)
+	daily := stats.daily[day]
+	daily.add(event)
+	stats.daily[day] = daily
+	sourceStats := stats.sources[source]
+	sourceStats.add(event)
+	stats.sources[source] = sourceStats
+	if _, exists := stats.users[user]; event == statRequest && !exists {
+		stats.users[user] = time.Now()
+	}
+	return nil
+}
+
+//Must be called with the mutex locked
+func (s *memoryStore) readStats(token string) tokenReport {
+	report := tokenReport{Token: token, Daily: make(map[string]tokenStats), Sources: make(map[string]tokenStats)}
+	stats := s.stats[token]
+	if stats == nil {
+		return report
+	}
+	report.Total = stats.total
+	for k, v := range stats.daily {
+		report.Daily[k] = v
+	}
+	for k, v := range stats.sources {
+		report.Sources[k] = v
+	}
+	report.UniqueUsers = len(stats.users)
+	return report
+}
+
+func (s *memoryStore) ReadStats(token string) (tokenReport, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.readStats(token), nil
+}
+
+func (s *memoryStore) ReadAllStats() ([]tokenReport, int, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	reports := make([]tokenReport, 0, len(s.stats))
+	users := make(map[int]struct{})
+	for token, stats := range s.stats {
+		reports = append(reports, s.readStats(token))
+		for user := range stats.users {
+			users[user] = struct{}{}
+		}
+	}
+	sortReports(reports)
+	return reports, len(users), nil
+}
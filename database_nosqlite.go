@@ -0,0 +1,18 @@
+//go:build !sqlite
+
+package main
+
+import "errors"
+
+//The SQLite driver needs cgo so this storage is only in the builds with the sqlite tag
+const sqliteSupported = false
+
+var errNoSQLite = errors.New("this build does not support sqlite; Build the bot with -tags sqlite")
+
+func openSQLStore(string) (Store, error) {
+	return nil, errNoSQLite
+}
+
+func checkSQLiteFile(string) error {
+	return errNoSQLite
+}
@@ -0,0 +1,692 @@
+//go:build sqlite
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+//The SQLite driver needs cgo so this storage is only in the builds with the sqlite tag
+const sqliteSupported = true
+
+//The tables are simple so they can be queried by reporting tools. The metadata of tokens are JSON; Use json_extract to query them
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS tokens (
+	token TEXT PRIMARY KEY,
+	value TEXT NOT NULL,
+	meta  TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS stats (
+	token    TEXT NOT NULL,
+	day      TEXT NOT NULL,
+	source   TEXT NOT NULL,
+	requests INTEGER NOT NULL DEFAULT 0,
+	pass     INTEGER NOT NULL DEFAULT 0,
+	fail     INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (token, day, source)
+);
+CREATE TABLE IF NOT EXISTS stat_users (
+	token      TEXT NOT NULL,
+	user_id    INTEGER NOT NULL,
+	first_seen TEXT NOT NULL,
+	PRIMARY KEY (token, user_id)
+);
+CREATE TABLE IF NOT EXISTS pool_items (
+	id      INTEGER PRIMARY KEY AUTOINCREMENT,
+	token   TEXT NOT NULL,
+	item    TEXT NOT NULL,
+	user_id INTEGER,
+	claimed TEXT
+);
+CREATE INDEX IF NOT EXISTS pool_items_token ON pool_items (token, user_id);
+CREATE TABLE IF NOT EXISTS jobs (
+	id   INTEGER PRIMARY KEY AUTOINCREMENT,
+	at   INTEGER NOT NULL,
+	job  TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS jobs_at ON jobs (at);
+CREATE TABLE IF NOT EXISTS records (
+	kind  TEXT NOT NULL,
+	key   TEXT NOT NULL,
+	value BLOB NOT NULL,
+	PRIMARY KEY (kind, key)
+);`
+
+//A store which keeps everything in a SQLite database
+type sqlStore struct {
+	db   *sql.DB
+	path string
+}
+
+func openSQLStore(name string) (*sqlStore, error) {
+	db, err := sql.Open("sqlite3", "file:"+name+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("could not open db, %v", err)
+	}
+	db.SetMaxOpenConns(1) //SQLite only has one writer
+	if _, err = db.Exec(sqliteSchema); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("could not set up tables, %v", err)
+	}
+	return &sqlStore{db, name}, nil
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+//Run f in a transaction; The transaction is committed if f does not return an error
+func (s *sqlStore) update(f func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = f(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func sqlTokenExists(tx *sql.Tx, key string) (bool, error) {
+	var one int
+	err := tx.QueryRow("SELECT 1 FROM tokens WHERE token = ?", key).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+//Inserts a value with its metadata in a transaction; If key is empty a random key is generated
+func sqlInsertValue(tx *sql.Tx, key, value string, meta tokenMeta) (string, error) {
+	if key == "" {
+		for { //Generate randoms until we find one which does not exist
+			key = generateRandomString()
+			exists, err := sqlTokenExists(tx, key)
+			if err != nil {
+				return "", err
+			}
+			if !exists {
+				break
+			}
+		}
+	} else if exists, err := sqlTokenExists(tx, key); err != nil {
+		return "", err
+	} else if exists {
+		return "", fmt.Errorf("the key %s already exists", key)
+	}
+	meta.Created = time.Now()
+	m, _ := json.Marshal(meta)
+	if _, err := tx.Exec("INSERT INTO tokens (token, value, meta) VALUES (?, ?, ?)", key, value, string(m)); err != nil {
+		return "", fmt.Errorf("could not write db: %v", err)
+	}
+	return key, nil
+}
+
+func (s *sqlStore) InsertValue(value string, meta tokenMeta) (string, error) {
+	var key string
+	err := s.update(func(tx *sql.Tx) error {
+		var err error
+		key, err = sqlInsertValue(tx, "", value, meta)
+		return err
+	})
+	return key, err
+}
+
+func (s *sqlStore) InsertValues(values []bulkValue) ([]bulkResult, error) {
+	results := make([]bulkResult, len(values))
+	err := s.update(func(tx *sql.Tx) error {
+		for i, value := range values {
+			results[i].Token, results[i].Err = sqlInsertValue(tx, value.Key, value.Value, value.Meta)
+		}
+		return nil
+	})
+	return results, err
+}
+
+func (s *sqlStore) HasKey(key string) bool {
+	var one int
+	return s.db.QueryRow("SELECT 1 FROM tokens WHERE token = ?", key).Scan(&one) == nil
+}
+
+func (s *sqlStore) RemoveKey(key string) error {
+	return s.update(func(tx *sql.Tx) error {
+		res, err := tx.Exec("DELETE FROM tokens WHERE token = ?", key)
+		if err != nil {
+			return fmt.Errorf("could not delete key: %v", err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Errorf("this token does not exits")
+		}
+		if _, err = tx.Exec("DELETE FROM stats WHERE token = ?", key); err != nil {
+			return fmt.Errorf("could not delete stats: %v", err)
+		}
+		if _, err = tx.Exec("DELETE FROM stat_users WHERE token = ?", key); err != nil {
+			return fmt.Errorf("could not delete stats: %v", err)
+		}
+		if _, err = tx.Exec("DELETE FROM pool_items WHERE token = ?", key); err != nil {
+			return fmt.Errorf("could not delete pool: %v", err)
+		}
+		return nil
+	})
+}
+
+func (s *sqlStore) ListAllValues() (map[string]string, error) {
+	rows, err := s.db.Query("SELECT token, value FROM tokens")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	m := make(map[string]string)
+	for rows.Next() {
+		var k, v string
+		if err = rows.Scan(&k, &v); err != nil {
+			return nil, err
+		}
+		m[k] = v
+	}
+	return m, rows.Err()
+}
+
+func (s *sqlStore) ListKeys() ([]string, error) {
+	rows, err := s.db.Query("SELECT token FROM tokens ORDER BY token")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var k string
+		if err = rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *sqlStore) ReadValue(key string) (string, error) {
+	var value string
+	err := s.db.QueryRow("SELECT value FROM tokens WHERE token = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("cannot find value for %s", key)
+	}
+	return value, err
+}
+
+func (s *sqlStore) UpdateValue(key, value string) error {
+	res, err := s.db.Exec("UPDATE tokens SET value = ? WHERE token = ?", value, key)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("this token does not exits")
+	}
+	return nil
+}
+
+func (s *sqlStore) ReadMeta(key string) (tokenMeta, error) {
+	var meta tokenMeta
+	var m string
+	err := s.db.QueryRow("SELECT meta FROM tokens WHERE token = ?", key).Scan(&m)
+	if err == sql.ErrNoRows {
+		return meta, nil
+	}
+	if err != nil {
+		return meta, err
+	}
+	if err = json.Unmarshal([]byte(m), &meta); err != nil {
+		return meta, fmt.Errorf("corrupted metadata: %v", err)
+	}
+	return meta, nil
+}
+
+func (s *sqlStore) UpdateMeta(key string, update func(meta *tokenMeta) error) error {
+	return s.update(func(tx *sql.Tx) error {
+		var m string
+		err := tx.QueryRow("SELECT meta FROM tokens WHERE token = ?", key).Scan(&m)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("this token does not exits")
+		}
+		if err != nil {
+			return err
+		}
+		var meta tokenMeta
+		if err = json.Unmarshal([]byte(m), &meta); err != nil {
+			return fmt.Errorf("corrupted metadata: %v", err)
+		}
+		if err = update(&meta); err != nil {
+			return err
+		}
+		newMeta, _ := json.Marshal(meta)
+		_, err = tx.Exec("UPDATE tokens SET meta = ? WHERE token = ?", string(newMeta), key)
+		return err
+	})
+}
+
+func (s *sqlStore) RevealValue(key string) (string, error) {
+	var value string
+	err := s.update(func(tx *sql.Tx) error {
+		var m string
+		err := tx.QueryRow("SELECT value, meta FROM tokens WHERE token = ?", key).Scan(&value, &m)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("cannot find value for %s", key)
+		}
+		if err != nil {
+			return err
+		}
+		var meta tokenMeta
+		if err = json.Unmarshal([]byte(m), &meta); err != nil {
+			return fmt.Errorf("corrupted metadata: %v", err)
+		}
+		if err = meta.check(); err != nil {
+			return err
+		}
+		meta.Uses++
+		newMeta, _ := json.Marshal(meta)
+		_, err = tx.Exec("UPDATE tokens SET meta = ? WHERE token = ?", string(newMeta), key)
+		return err
+	})
+	return value, err
+}
+
+func (s *sqlStore) AddPoolItems(token string, items []string) error {
+	return s.update(func(tx *sql.Tx) error {
+		for _, item := range items {
+			if _, err := tx.Exec("INSERT INTO pool_items (token, item) VALUES (?, ?)", token, item); err != nil {
+				return fmt.Errorf("could not write pool: %v", err)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqlStore) ClaimPoolItem(token string, user int) (item string, remaining int, claimed bool, err error) {
+	err = s.update(func(tx *sql.Tx) error {
+		err := tx.QueryRow("SELECT COUNT(*) FROM pool_items WHERE token = ? AND user_id IS NULL", token).Scan(&remaining)
+		if err != nil {
+			return err
+		}
+		err = tx.QueryRow("SELECT item FROM pool_items WHERE token = ? AND user_id = ?", token, user).Scan(&item)
+		if err != sql.ErrNoRows { //User has already got an item
+			return err
+		}
+		var m string
+		if err = tx.QueryRow("SELECT meta FROM tokens WHERE token = ?", token).Scan(&m); err != nil {
+			return err
+		}
+		var meta tokenMeta
+		if err = json.Unmarshal([]byte(m), &meta); err != nil {
+			return fmt.Errorf("corrupted metadata: %v", err)
+		}
+		if err = meta.check(); err != nil {
+			return err
+		}
+		var id int64
+		err = tx.QueryRow("SELECT id, item FROM pool_items WHERE token = ? AND user_id IS NULL ORDER BY id LIMIT 1", token).Scan(&id, &item)
+		if err == sql.ErrNoRows {
+			return errPoolEmpty
+		}
+		if err != nil {
+			return err
+		}
+		remaining--
+		claimed = true
+		meta.Uses++
+		if _, err = tx.Exec("UPDATE pool_items SET user_id = ?, claimed = ? WHERE id = ?", user, time.Now().Format(time.RFC3339), id); err != nil {
+			return err
+		}
+		newMeta, _ := json.Marshal(meta)
+		_, err = tx.Exec("UPDATE tokens SET meta = ? WHERE token = ?", string(newMeta), token)
+		return err
+	})
+	return
+}
+
+func (s *sqlStore) RewritePoolItems(token string, rewrite func(item string) (string, error)) (int, error) {
+	changed := 0
+	err := s.update(func(tx *sql.Tx) error {
+		changed = 0
+		rows, err := tx.Query("SELECT id, item FROM pool_items WHERE token = ?", token)
+		if err != nil {
+			return err
+		}
+		updates := make(map[int64]string)
+		for rows.Next() {
+			var id int64
+			var item string
+			if err = rows.Scan(&id, &item); err != nil {
+				rows.Close()
+				return err
+			}
+			rewritten, err := rewrite(item)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			if rewritten != item {
+				updates[id] = rewritten
+			}
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		for id, item := range updates {
+			if _, err = tx.Exec("UPDATE pool_items SET item = ? WHERE id = ?", item, id); err != nil {
+				return fmt.Errorf("could not write pool: %v", err)
+			}
+		}
+		changed = len(updates)
+		return nil
+	})
+	return changed, err
+}
+
+func (s *sqlStore) PoolStatus(token string) (total, claimed int, err error) {
+	err = s.db.QueryRow("SELECT COUNT(*), COUNT(user_id) FROM pool_items WHERE token = ?", token).Scan(&total, &claimed)
+	return
+}
+
+func (s *sqlStore) AddJob(job scheduledJob) error {
+	v, _ := json.Marshal(job)
+	_, err := s.db.Exec("INSERT INTO jobs (at, job) VALUES (?, ?)", job.At.UnixNano(), string(v))
+	return err
+}
+
+func (s *sqlStore) DueJobs(now time.Time) ([]scheduledJob, error) {
+	var jobs []scheduledJob
+	err := s.update(func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT job FROM jobs WHERE at <= ? ORDER BY at", now.UnixNano())
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var v string
+			var job scheduledJob
+			if err = rows.Scan(&v); err != nil {
+				_ = rows.Close()
+				return err
+			}
+			if err = json.Unmarshal([]byte(v), &job); err != nil {
+				log.Println("Removing corrupted job:", err.Error())
+				continue
+			}
+			jobs = append(jobs, job)
+		}
+		_ = rows.Close()
+		_, err = tx.Exec("DELETE FROM jobs WHERE at <= ?", now.UnixNano())
+		return err
+	})
+	return jobs, err
+}
+
+func (s *sqlStore) PutRecord(kind, key string, value []byte) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO records (kind, key, value) VALUES (?, ?, ?)", kind, key, value)
+	return err
+}
+
+func (s *sqlStore) GetRecord(kind, key string) ([]byte, error) {
+	var value []byte
+	err := s.db.QueryRow("SELECT value FROM records WHERE kind = ? AND key = ?", kind, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, errRecordNotFound
+	}
+	return value, err
+}
+
+func (s *sqlStore) UpdateRecord(kind, key string, update func(value []byte) ([]byte, error)) error {
+	return s.update(func(tx *sql.Tx) error {
+		var value []byte
+		err := tx.QueryRow("SELECT value FROM records WHERE kind = ? AND key = ?", kind, key).Scan(&value)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if value, err = update(value); err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT OR REPLACE INTO records (kind, key, value) VALUES (?, ?, ?)", kind, key, value)
+		return err
+	})
+}
+
+func (s *sqlStore) TakeRecord(kind, key string) ([]byte, error) {
+	var value []byte
+	err := s.update(func(tx *sql.Tx) error {
+		err := tx.QueryRow("SELECT value FROM records WHERE kind = ? AND key = ?", kind, key).Scan(&value)
+		if err == sql.ErrNoRows {
+			return errRecordNotFound
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM records WHERE kind = ? AND key = ?", kind, key)
+		return err
+	})
+	return value, err
+}
+
+func (s *sqlStore) DeleteRecord(kind, key string) error {
+	_, err := s.db.Exec("DELETE FROM records WHERE kind = ? AND key = ?", kind, key)
+	return err
+}
+
+func (s *sqlStore) ForEachRecord(kind string, f func(key string, value []byte) error) error {
+	rows, err := s.db.Query("SELECT key, value FROM records WHERE kind = ?", kind)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var value []byte
+		if err = rows.Scan(&key, &value); err != nil {
+			return err
+		}
+		if err = f(key, value); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+//The column of the stats table which counts the event
+func (event statEvent) column() string {
+	switch event {
+	case statPass:
+		return "pass"
+	case statFail:
+		return "fail"
+	}
+	return "requests"
+}
+
+func (s *sqlStore) RecordStat(token, source string, user int, event statEvent) error {
+	if source == "" {
+		source = directSource
+	}
+	return s.update(func(tx *sql.Tx) error {
+		if exists, err := sqlTokenExists(tx, token); err != nil || !exists {
+			return err
+		}
+		day := time.Now().Format(dayFormat)
+		_, err := tx.Exec("INSERT OR IGNORE INTO stats (token, day, source) VALUES (?, ?, ?)", token, day, source)
+		if err != nil {
+			return err
+		}
+		column := event.column()
+		_, err = tx.Exec("UPDATE stats SET "+column+" = "+column+" + 1 WHERE token = ? AND day = ? AND source = ?", token, day, source)
+		if err != nil || event != statRequest {
+			return err
+		}
+		_, err = tx.Exec("INSERT OR IGNORE INTO stat_users (token, user_id, first_seen) VALUES (?, ?, ?)", token, user, time.Now().Format(time.RFC3339))
+		return err
+	})
+}
+
+//Sum the stats of a token grouped by a column; The total is returned if group is empty
+func (s *sqlStore) sumStats(token, group string) (map[string]tokenStats, error) {
+	key := "''"
+	if group != "" {
+		key = group
+	}
+	query := "SELECT " + key + ", SUM(requests), SUM(pass), SUM(fail) FROM stats WHERE token = ?"
+	if group != "" {
+		query += " GROUP BY " + group
+	}
+	rows, err := s.db.Query(query, token)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	m := make(map[string]tokenStats)
+	for rows.Next() {
+		var k string
+		var requests, pass, fail sql.NullInt64 //SUM is NULL when there is no row
+		if err = rows.Scan(&k, &requests, &pass, &fail); err != nil {
+			return nil, err
+		}
+		m[k] = tokenStats{uint64(requests.Int64), uint64(pass.Int64), uint64(fail.Int64)}
+	}
+	return m, rows.Err()
+}
+
+func (s *sqlStore) ReadStats(token string) (tokenReport, error) {
+	report := tokenReport{Token: token}
+	total, err := s.sumStats(token, "")
+	if err != nil {
+		return report, err
+	}
+	report.Total = total[""]
+	if report.Daily, err = s.sumStats(token, "day"); err != nil {
+		return report, err
+	}
+	if report.Sources, err = s.sumStats(token, "source"); err != nil {
+		return report, err
+	}
+	err = s.db.QueryRow("SELECT COUNT(*) FROM stat_users WHERE token = ?", token).Scan(&report.UniqueUsers)
+	return report, err
+}
+
+func (s *sqlStore) ReadAllStats() ([]tokenReport, int, error) {
+	rows, err := s.db.Query("SELECT DISTINCT token FROM stats")
+	if err != nil {
+		return nil, 0, err
+	}
+	var tokens []string
+	for rows.Next() {
+		var token string
+		if err = rows.Scan(&token); err != nil {
+			_ = rows.Close()
+			return nil, 0, err
+		}
+		tokens = append(tokens, token)
+	}
+	_ = rows.Close()
+	reports := make([]tokenReport, 0, len(tokens))
+	for _, token := range tokens {
+		report, err := s.ReadStats(token)
+		if err != nil {
+			return nil, 0, err
+		}
+		reports = append(reports, report)
+	}
+	sortReports(reports)
+	var users int
+	err = s.db.QueryRow("SELECT COUNT(DISTINCT user_id) FROM stat_users").Scan(&users)
+	return reports, users, err
+}
+
+//Write a copy of the database to a new file while the bot is running
+func (s *sqlStore) Snapshot(name string) error {
+	_, err := s.db.Exec("VACUUM INTO ?", name)
+	return err
+}
+
+func (s *sqlStore) Compact() error {
+	_, err := s.db.Exec("VACUUM")
+	return err
+}
+
+func (s *sqlStore) Verify() ([]string, error) {
+	problems, err := sqliteIntegrity(s.db)
+	if err != nil {
+		return nil, err
+	}
+	//Every token must have a readable metadata
+	keys, err := s.ListKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if _, err = s.ReadMeta(key); err != nil {
+			problems = append(problems, fmt.Sprintf("Token %s: %v", key, err))
+		}
+	}
+	return problems, nil
+}
+
+func (s *sqlStore) Info() (string, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("File: %s\nSize: %d bytes\n", s.path, info.Size()))
+	for _, table := range []string{"tokens", "stats", "stat_users", "pool_items", "jobs", "records"} {
+		var n int
+		if err = s.db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+			return "", err
+		}
+		sb.WriteString(fmt.Sprintf("Table %s: %d rows\n", table, n))
+	}
+	return sb.String(), nil
+}
+
+//Run the integrity check of SQLite
+func sqliteIntegrity(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err = rows.Scan(&result); err != nil {
+			return nil, err
+		}
+		if result != "ok" {
+			problems = append(problems, "Corruption: "+result)
+		}
+	}
+	return problems, rows.Err()
+}
+
+//Make sure that the backup is a valid SQLite database
+func checkSQLiteFile(name string) error {
+	if _, err := os.Stat(name); err != nil {
+		return fmt.Errorf("could not open the backup: %v", err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+name+"?mode=ro")
+	if err != nil {
+		return fmt.Errorf("could not open the backup: %v", err)
+	}
+	defer db.Close()
+	problems, err := sqliteIntegrity(db)
+	if err != nil {
+		return fmt.Errorf("could not open the backup: %v", err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("the backup is corrupted: %s", problems[0])
+	}
+	return nil
+}
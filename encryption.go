@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+//Encrypted values look like enc:<key id>:<base64 of nonce and cipher text>
+//The token is the additional data of AES-GCM so a value or an item cannot be moved to another token in the database
+//Values without this prefix are plaintext and are returned as they are; They can be encrypted with "db encrypt" command
+const encryptedPrefix = "enc:"
+
+//A store which encrypts the values with AES-GCM before saving them in another store
+type encryptedStore struct {
+	Store
+	current cipherKey
+	keys    map[string]cipherKey //Key IDs to all of the keys which can decrypt, including the current one
+}
+
+type cipherKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+//Parse a 32 byte key which is encoded in base64 or hex
+func parseKey(encoded string) (cipherKey, error) {
+	encoded = strings.TrimSpace(encoded)
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(raw) != 32 {
+		raw, err = hex.DecodeString(encoded)
+	}
+	if err != nil || len(raw) != 32 {
+		return cipherKey{}, fmt.Errorf("the key must be 32 bytes encoded in base64 or hex")
+	}
+	block, _ := aes.NewCipher(raw)
+	aead, _ := cipher.NewGCM(block)
+	id := sha256.Sum256(raw)
+	return cipherKey{hex.EncodeToString(id[:4]), aead}, nil
+}
+
+//Read the current key from the config, the environment variable or the key file in this order
+//Returns an empty string if encryption is not enabled
+func loadEncryptionKey(conf encryptionConfig) (string, error) {
+	if conf.Key != "" {
+		return conf.Key, nil
+	}
+	if conf.KeyEnv != "" {
+		if key := os.Getenv(conf.KeyEnv); key != "" {
+			return key, nil
+		}
+	}
+	if conf.KeyFile != "" {
+		key, err := ioutil.ReadFile(conf.KeyFile)
+		if err != nil {
+			return "", fmt.Errorf("could not read the key file: %v", err)
+		}
+		return string(key), nil
+	}
+	return "", nil
+}
+
+//Wrap a store to encrypt its values if encryption is enabled in the config
+func newEncryptedStore(store Store, conf encryptionConfig) (Store, error) {
+	key, err := loadEncryptionKey(conf)
+	if err != nil || key == "" {
+		return store, err
+	}
+	s := &encryptedStore{Store: store, keys: make(map[string]cipherKey)}
+	if s.current, err = parseKey(key); err != nil {
+		return nil, err
+	}
+	s.keys[s.current.id] = s.current
+	for _, old := range conf.OldKeys {
+		k, err := parseKey(old)
+		if err != nil {
+			return nil, fmt.Errorf("invalid old key: %v", err)
+		}
+		s.keys[k.id] = k
+	}
+	return s, nil
+}
+
+//The additional data of the pool items; It is different from the one of the value so they cannot be swapped
+func poolData(token string) string {
+	return "pool:" + token
+}
+
+//Encrypt a value with the current key; data is the token of the value or poolData of the token
+func (s *encryptedStore) encrypt(data, value string) string {
+	nonce := make([]byte, s.current.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic("cannot generate random nonce: " + err.Error())
+	}
+	sealed := s.current.aead.Seal(nonce, nonce, []byte(value), []byte(data))
+	return encryptedPrefix + s.current.id + ":" + base64.StdEncoding.EncodeToString(sealed)
+}
+
+//Decrypt a value which is encrypted with any of the keys; data must be the same as when it was encrypted
+func (s *encryptedStore) decrypt(data, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) { //Not migrated yet
+		return value, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, encryptedPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("corrupted encrypted value")
+	}
+	key, ok := s.keys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("the value is encrypted with an unknown key %s", parts[0])
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < key.aead.NonceSize() {
+		return "", fmt.Errorf("corrupted encrypted value")
+	}
+	plain, err := key.aead.Open(nil, sealed[:key.aead.NonceSize()], sealed[key.aead.NonceSize():], []byte(data))
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt the value: %v", err)
+	}
+	return string(plain), nil
+}
+
+//A random token which does not exist yet; The tokens are generated here because the values are encrypted with them
+func (s *encryptedStore) newKey(taken map[string]bool) string {
+	for {
+		if key := generateRandomString(); !taken[key] && !s.Store.HasKey(key) {
+			return key
+		}
+	}
+}
+
+func (s *encryptedStore) InsertValue(value string, meta tokenMeta) (string, error) {
+	for {
+		key := s.newKey(nil)
+		results, err := s.Store.InsertValues([]bulkValue{{Key: key, Value: s.encrypt(key, value), Meta: meta}})
+		if err != nil {
+			return "", err
+		}
+		if results[0].Err != nil && s.Store.HasKey(key) { //Another value took the key after newKey
+			continue
+		}
+		return results[0].Token, results[0].Err
+	}
+}
+
+func (s *encryptedStore) InsertValues(values []bulkValue) ([]bulkResult, error) {
+	encrypted := make([]bulkValue, len(values))
+	taken := make(map[string]bool)
+	for i, value := range values {
+		encrypted[i] = value
+		if value.Key == "" {
+			encrypted[i].Key = s.newKey(taken)
+			taken[encrypted[i].Key] = true
+		}
+		encrypted[i].Value = s.encrypt(encrypted[i].Key, value.Value)
+	}
+	return s.Store.InsertValues(encrypted)
+}
+
+func (s *encryptedStore) UpdateValue(key, value string) error {
+	return s.Store.UpdateValue(key, s.encrypt(key, value))
+}
+
+func (s *encryptedStore) AddPoolItems(token string, items []string) error {
+	encrypted := make([]string, len(items))
+	for i, item := range items {
+		encrypted[i] = s.encrypt(poolData(token), item)
+	}
+	return s.Store.AddPoolItems(token, encrypted)
+}
+
+func (s *encryptedStore) ClaimPoolItem(token string, user int) (string, int, bool, error) {
+	item, remaining, claimed, err := s.Store.ClaimPoolItem(token, user)
+	if err != nil {
+		return "", remaining, claimed, err
+	}
+	item, err = s.decrypt(poolData(token), item)
+	return item, remaining, claimed, err
+}
+
+func (s *encryptedStore) ReadValue(key string) (string, error) {
+	value, err := s.Store.ReadValue(key)
+	if err != nil {
+		return "", err
+	}
+	return s.decrypt(key, value)
+}
+
+func (s *encryptedStore) RevealValue(key string) (string, error) {
+	value, err := s.Store.RevealValue(key)
+	if err != nil {
+		return "", err
+	}
+	return s.decrypt(key, value)
+}
+
+func (s *encryptedStore) ListAllValues() (map[string]string, error) {
+	m, err := s.Store.ListAllValues()
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range m {
+		if m[k], err = s.decrypt(k, v); err != nil {
+			return nil, fmt.Errorf("token %s: %v", k, err)
+		}
+	}
+	return m, nil
+}
+
+func (s *encryptedStore) Unwrap() Store {
+	return s.Store
+}
+
+//Encrypt all of the values and pool items which are plaintext or encrypted with an old key with the current key
+//Returns the number of the values and items which are changed
+func (s *encryptedStore) Migrate() (int, error) {
+	keys, err := s.Store.ListKeys()
+	if err != nil {
+		return 0, err
+	}
+	changed := 0
+	for _, key := range keys {
+		raw, err := s.Store.ReadValue(key)
+		if err != nil {
+			return changed, err
+		}
+		if !strings.HasPrefix(raw, encryptedPrefix+s.current.id+":") {
+			plain, err := s.decrypt(key, raw)
+			if err != nil {
+				return changed, fmt.Errorf("token %s: %v", key, err)
+			}
+			if err = s.UpdateValue(key, plain); err != nil {
+				return changed, fmt.Errorf("token %s: %v", key, err)
+			}
+			changed++
+		}
+		items, err := s.Store.RewritePoolItems(key, func(item string) (string, error) {
+			if strings.HasPrefix(item, encryptedPrefix+s.current.id+":") {
+				return item, nil
+			}
+			plain, err := s.decrypt(poolData(key), item)
+			if err != nil {
+				return "", err
+			}
+			return s.encrypt(poolData(key), plain), nil
+		})
+		changed += items
+		if err != nil {
+			return changed, fmt.Errorf("pool %s: %v", key, err)
+		}
+	}
+	return changed, nil
+}
+
+//Create a random key for the config
+func generateKey() string {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic("cannot generate random key: " + err.Error())
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+//Stores which wrap another store
+type wrapperStore interface {
+	Unwrap() Store
+}
+
+//Get the innermost store to check the optional features of it
+func baseStore(s Store) Store {
+	for {
+		wrapper, ok := s.(wrapperStore)
+		if !ok {
+			return s
+		}
+		s = wrapper.Unwrap()
+	}
+}
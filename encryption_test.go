@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	oldKey, newKey := generateKey(), generateKey()
+	for kind, base := range openTestStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			old, err := newEncryptedStore(base, encryptionConfig{Key: oldKey})
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, err := old.InsertValue("secret value", tokenMeta{Pool: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = old.AddPoolItems(token, []string{"item 1", "item 2"}); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, _, err = old.ClaimPoolItem(token, 1); err != nil {
+				t.Fatal(err)
+			}
+
+			rotating, err := newEncryptedStore(base, encryptionConfig{Key: newKey, OldKeys: []string{oldKey}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			changed, err := rotating.(*encryptedStore).Migrate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed != 3 { //The value and both of the items
+				t.Errorf("Migrate changed %d values, want 3", changed)
+			}
+			if changed, _ = rotating.(*encryptedStore).Migrate(); changed != 0 {
+				t.Errorf("second Migrate changed %d values, want 0", changed)
+			}
+
+			rotated, err := newEncryptedStore(base, encryptionConfig{Key: newKey}) //The old key is dropped
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value, err := rotated.ReadValue(token); err != nil || value != "secret value" {
+				t.Errorf("ReadValue = %q, %v; want the value", value, err)
+			}
+			if item, _, _, err := rotated.ClaimPoolItem(token, 1); err != nil || item != "item 1" {
+				t.Errorf("ClaimPoolItem of the old user = %q, %v; want item 1", item, err)
+			}
+			if item, _, _, err := rotated.ClaimPoolItem(token, 2); err != nil || item != "item 2" {
+				t.Errorf("ClaimPoolItem of a new user = %q, %v; want item 2", item, err)
+			}
+		})
+	}
+}
+
+func TestEncryptionBindsToken(t *testing.T) {
+	for kind, base := range openTestStores(t) {
+		t.Run(kind, func(t *testing.T) {
+			s, err := newEncryptedStore(base, encryptionConfig{Key: generateKey()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			first, err := s.InsertValue("first", tokenMeta{Pool: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			results, err := s.InsertValues([]bulkValue{{Value: "second"}, {Key: "custom", Value: "third"}})
+			if err != nil || results[0].Err != nil || results[1].Err != nil {
+				t.Fatal(err, results)
+			}
+			second := results[0].Token
+			for token, want := range map[string]string{first: "first", second: "second", "custom": "third"} {
+				if value, err := s.ReadValue(token); err != nil || value != want {
+					t.Errorf("ReadValue(%s) = %q, %v; want %q", token, value, err, want)
+				}
+			}
+
+			//Someone with access to the database copies a value to another token
+			raw, _ := base.ReadValue(first)
+			if err = base.UpdateValue(second, raw); err != nil {
+				t.Fatal(err)
+			}
+			if value, err := s.ReadValue(second); err == nil {
+				t.Errorf("ReadValue of a moved value = %q; want an error", value)
+			}
+			if err = base.AddPoolItems(first, []string{raw}); err != nil {
+				t.Fatal(err)
+			}
+			if item, _, _, err := s.ClaimPoolItem(first, 1); err == nil {
+				t.Errorf("ClaimPoolItem of the value of the token = %q; want an error", item)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+//A bucket in the dump; Values are base64 encoded by JSON because they might be binary
+type dumpBucket struct {
+	Values  map[string][]byte      `json:",omitempty"`
+	Buckets map[string]*dumpBucket `json:",omitempty"`
+}
+
+//The whole database in a dump
+type databaseDump struct {
+	Version string
+	Created time.Time
+	Buckets map[string]*dumpBucket
+}
+
+//Write a gzip compressed JSON dump of every bucket of the database to w
+func (s *boltStore) Export(w io.Writer) error {
+	dump := databaseDump{Version: Version, Created: time.Now(), Buckets: make(map[string]*dumpBucket)}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			var err error
+			dump.Buckets[string(name)], err = dumpBolt(b)
+			return err
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("could not read the database: %v", err)
+	}
+	gz := gzip.NewWriter(w)
+	if err = json.NewEncoder(gz).Encode(dump); err != nil {
+		return fmt.Errorf("could not write the dump: %v", err)
+	}
+	return gz.Close()
+}
+
+func dumpBolt(b *bolt.Bucket) (*dumpBucket, error) {
+	dump := &dumpBucket{Values: make(map[string][]byte), Buckets: make(map[string]*dumpBucket)}
+	err := b.ForEach(func(k, v []byte) error {
+		if v != nil {
+			dump.Values[string(k)] = append([]byte(nil), v...)
+			return nil
+		}
+		var err error
+		dump.Buckets[string(k)], err = dumpBolt(b.Bucket(k))
+		return err
+	})
+	return dump, err
+}
+
+//Restore a dump which is created by Export. The dump can be compressed or not
+//If overwrite is true the database is cleared first; Otherwise the existing keys are kept and only the new ones are added
+func (s *boltStore) Import(r io.Reader, overwrite bool) error {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("invalid gzip file: %v", err)
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+	var dump databaseDump
+	if err := json.NewDecoder(r).Decode(&dump); err != nil {
+		return fmt.Errorf("invalid dump: %v", err)
+	}
+	if dump.Buckets == nil {
+		return fmt.Errorf("invalid dump: there is no bucket in it")
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if overwrite {
+			var names [][]byte
+			_ = tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+				names = append(names, append([]byte(nil), name...))
+				return nil
+			})
+			for _, name := range names {
+				if err := tx.DeleteBucket(name); err != nil {
+					return fmt.Errorf("could not clear bucket %s: %v", name, err)
+				}
+			}
+		}
+		for name, bucket := range dump.Buckets {
+			b, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return fmt.Errorf("could not create bucket %s: %v", name, err)
+			}
+			if err = restoreBolt(b, bucket); err != nil {
+				return err
+			}
+		}
+		return createBuckets(tx)
+	})
+}
+
+func restoreBolt(b *bolt.Bucket, dump *dumpBucket) error {
+	for k, v := range dump.Values {
+		if b.Get([]byte(k)) != nil {
+			continue
+		}
+		if err := b.Put([]byte(k), v); err != nil {
+			return fmt.Errorf("could not write %s: %v", k, err)
+		}
+	}
+	for name, bucket := range dump.Buckets {
+		child, err := b.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return fmt.Errorf("could not create bucket %s: %v", name, err)
+		}
+		if err = restoreBolt(child, bucket); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//The file name of the exports
+func exportFileName() string {
+	return "captchabot-" + time.Now().Format("2006-01-02-150405") + ".json.gz"
+}
+
+//Export the database to w if the store supports it
+func ExportDB(w io.Writer) error {
+	dumper, ok := baseStore(store).(dumpStore)
+	if !ok {
+		return errNotSupported
+	}
+	return dumper.Export(w)
+}
+
+//Import a dump to the database if the store supports it
+func ImportDB(r io.Reader, overwrite bool) error {
+	dumper, ok := baseStore(store).(dumpStore)
+	if !ok {
+		return errNotSupported
+	}
+	return dumper.Import(r, overwrite)
+}
+
+//Export the database to a file
+func exportToFile(name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err = ExportDB(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+//Import a backup file to the database
+func importFromFile(name string, overwrite bool) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return ImportDB(f, overwrite)
+}
+
+//Restore a backup which the admin sent
+func processImportFile(chatID int64, document *tgbotapi.Document, overwrite bool) {
+	data, err := downloadFile(document.FileID)
+	if err != nil {
+		botSend(tgbotapi.NewMessage(chatID, "Error on downloading the file: "+err.Error()))
+		return
+	}
+	if err = ImportDB(bytes.NewReader(data), overwrite); err != nil {
+		botSend(tgbotapi.NewMessage(chatID, "Error on importing the backup: "+err.Error()))
+		return
+	}
+	botSend(tgbotapi.NewMessage(chatID, "Successfully imported the backup!"))
+}
@@ -0,0 +1,18 @@
+module github.com/HirbodBehnam/CaptchaBot
+
+go 1.18
+
+require (
+	github.com/boltdb/bolt v1.3.1
+	github.com/dchest/captcha v1.1.0
+	github.com/go-telegram-bot-api/telegram-bot-api v4.6.4+incompatible
+	github.com/mattn/go-sqlite3 v1.14.22
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	golang.org/x/crypto v0.24.0
+	golang.org/x/image v0.18.0
+)
+
+require (
+	github.com/technoweenie/multipartstreamer v1.0.1 // indirect
+	golang.org/x/sys v0.21.0 // indirect
+)
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+//The directory of the catalogs if Config.Locales is empty
+const defaultLocales = "locales"
+
+//The messages of the users in English; The catalogs of the other languages have the same keys
+//Missing keys of a catalog fall back to these
+var englishCatalog = map[string]string{
+	"language_name":        "English",
+	"direction":            "ltr",
+	"welcome":              "Welcome! Please send the token you received to get the text or the link.",
+	"invalid_token":        "The token you provided is in valid or does not exists.",
+	"send_token_first":     "Please send the bot a token first.",
+	"captcha_fail":         "Captcha fail. Please try again by sending the _token_ again.",
+	"captcha_image":        "Please enter the number in this image\n/cancel to turn back",
+	"captcha_error":        "Error on encoding captcha.",
+	"open_v2":              "Open this url and complete the captcha:\n%s",
+	"open_v3":              "Open this url and wait:\n%s",
+	"database_error":       "Error retrieving data from database: %s",
+	"token_expired":        "Sorry, this token has expired.",
+	"token_used_up":        "Sorry, this token has reached its usage limit.",
+	"pool_empty":           "Sorry, all of the items of this token are given away.",
+	"not_released":         "Sorry, this token is not available yet.",
+	"delete_notice":        "\n\n(This message will be deleted in %s)",
+	"password_ask":         "This token is protected with a password. Please send the password.\n/cancel to turn back",
+	"password_wrong":       "Wrong password. You have %d attempts left.",
+	"password_no_attempts": "Wrong password. You have no attempts left; Send the token again to retry.",
+	"password_expired":     "You did not send the password in time; Send the token again to retry.",
+	"approval_waiting":     "Your request is already waiting for the approval of the admins.",
+	"approval_asked":       "This token needs the approval of the admins. You will receive it as soon as they approve your request.",
+	"approval_approved":    "An admin approved your request.",
+	"approval_denied":      "Sorry, an admin denied your request for this token.",
+	"approval_failed":      "Sorry, your request could not be sent to the admins. Please try again later.",
+	"save_error":           "Error on saving your request: %s",
+	"countdown":            "This token is not available yet. It will be available in %s at %s.",
+	"notify_button":        "Notify me",
+	"notify_saved":         "You will be notified when this token is available.",
+	"notify_gone":          "This token does not exist anymore.",
+	"notify_available":     "This token is available now. Send it again to receive it.",
+	"notify_resend":        "Please send the token again.",
+	"released":             "The token %s is available now!",
+	"banned":               "You are banned from this bot.",
+	"cancelled":            "You can now send a token to bot to access it's data.",
+	"unknown_command":      "I don't know that command",
+	"not_admin":            "You are not the admin of this bot!",
+	"conversation_expired": "Your /%s has expired. Please send the command again.",
+	"language_choose":      "Your language is %s. Choose a language:",
+	"language_set":         "Your language is now %s.",
+	"language_unknown":     "There is no %s translation. Choose a language:",
+	"command_start":        "Start the bot",
+	"command_language":     "Change the language of the bot",
+	"command_cancel":       "Cancel the current command",
+	"command_id":           "Get your ID",
+	"command_about":        "About the bot",
+	"page_title":           "Recaptcha Test",
+	"page_check":           "Please check the dialog and choose OK after",
+	"page_button":          "Ok",
+	"page_wait":            "Please wait...",
+	"page_sent":            "Sent the code via telegram!",
+	"page_wrong_v2":        "Recaptcha was incorrect; try again.",
+	"page_wrong_v3":        "Unfortunately you are not worthy enough to access this right now.",
+	"page_bad_request":     "This link is invalid. Please send the token to the bot again.",
+}
+
+//The loaded catalogs by their language code; English is always there
+var catalogs = map[string]map[string]string{"en": englishCatalog}
+
+//The messages which the operator has replaced; Keys are like welcome or fa.welcome for a single language
+var messageOverrides = make(map[string]*template.Template)
+
+//The data of the message overrides
+type messageData struct {
+	BotName     string
+	BotUserName string
+	UserID      int //Zero if the user is unknown
+	FirstName   string
+	LastName    string
+	UserName    string
+	Language    string
+	Token       string            //Empty if the message is not about a token
+	Default     string            //The message of the catalog
+	Args        []interface{}     //The values which are formatted into the message of the catalog
+	Vars        map[string]string //Config.Templates.Vars
+}
+
+//Read the <language>.json files of the locales directory. A missing directory only leaves English
+func loadCatalogs(dir string) error {
+	if dir == "" {
+		dir = defaultLocales
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return fmt.Errorf("could not list the catalogs: %v", err)
+	}
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %v", file, err)
+		}
+		var catalog map[string]string
+		if err = json.Unmarshal(b, &catalog); err != nil {
+			return fmt.Errorf("could not parse %s: %v", file, err)
+		}
+		lang := strings.ToLower(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if existing, exists := catalogs[lang]; exists { //Let the files change the English texts as well
+			for key, text := range catalog {
+				existing[key] = text
+			}
+			continue
+		}
+		catalogs[lang] = catalog
+	}
+	if len(files) > 0 {
+		log.Println("Loaded", len(files), "catalogs from", dir)
+	}
+	return nil
+}
+
+//Read the JSON file of the message overrides; Its values are text/template templates
+func loadMessageOverrides(file string) error {
+	if file == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %v", file, err)
+	}
+	var texts map[string]string
+	if err = json.Unmarshal(b, &texts); err != nil {
+		return fmt.Errorf("could not parse %s: %v", file, err)
+	}
+	for key, text := range texts {
+		t, err := template.New(key).Parse(text)
+		if err != nil {
+			return fmt.Errorf("could not parse the %s message: %v", key, err)
+		}
+		messageOverrides[key] = t
+	}
+	return nil
+}
+
+//The codes of the loaded languages in a stable order
+func languages() []string {
+	list := make([]string, 0, len(catalogs))
+	for lang := range catalogs {
+		list = append(list, lang)
+	}
+	sort.Strings(list)
+	return list
+}
+
+//The first loaded language of codes; Codes like pt-br are matched with their base language as well
+//Config.Language and then English are used if none of them are loaded
+func pickLanguage(codes ...string) string {
+	for _, code := range append(codes, Config.Language) {
+		code = strings.ToLower(code)
+		if _, exists := catalogs[code]; exists {
+			return code
+		}
+		if i := strings.IndexAny(code, "-_"); i != -1 {
+			if _, exists := catalogs[code[:i]]; exists {
+				return code[:i]
+			}
+		}
+	}
+	return "en"
+}
+
+//The user of a private chat; The ID of the private chat of a user is the ID of the user
+//Unknown users and groups are empty
+func chatUser(chatID int64) botUser {
+	var u botUser
+	if err := getJSONRecord(userRecords, strconv.FormatInt(chatID, 10), &u); err != nil {
+		return botUser{}
+	}
+	return u
+}
+
+//The language of a chat
+func chatLanguage(chatID int64) string {
+	u := chatUser(chatID)
+	return pickLanguage(u.Language, u.LanguageCode)
+}
+
+//A message in a language; args are formatted into the text if there is any
+func translate(lang, key string, args ...interface{}) string {
+	text, exists := catalogs[lang][key]
+	if !exists {
+		text = englishCatalog[key]
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(text, args...)
+	}
+	return text
+}
+
+//A message in the language of a chat
+func tr(chatID int64, key string, args ...interface{}) string {
+	return trToken(chatID, "", key, args...)
+}
+
+//A message about a token in the language of a chat; The token is given to the overrides of the operator
+func trToken(chatID int64, token, key string, args ...interface{}) string {
+	u := chatUser(chatID)
+	lang := pickLanguage(u.Language, u.LanguageCode)
+	text := translate(lang, key, args...)
+	override, exists := messageOverrides[lang+"."+key]
+	if !exists {
+		if override, exists = messageOverrides[key]; !exists {
+			return text
+		}
+	}
+	var sb strings.Builder
+	err := override.Execute(&sb, messageData{
+		BotName:     bot.Self.FirstName,
+		BotUserName: bot.Self.UserName,
+		UserID:      u.ID,
+		FirstName:   u.FirstName,
+		LastName:    u.LastName,
+		UserName:    u.UserName,
+		Language:    lang,
+		Token:       token,
+		Default:     text,
+		Args:        args,
+		Vars:        Config.Templates.Vars,
+	})
+	if err != nil {
+		log.Println("Cannot render the", key, "message:", err.Error())
+		return text
+	}
+	return sb.String()
+}
+
+//The keyboard of /language
+func languageKeyboard() tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, lang := range languages() {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(translate(lang, "language_name"), "lang:"+lang)))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+//Use /language to choose from the buttons or /language code to set it directly
+func languageCommand(message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+	lang := strings.ToLower(strings.TrimSpace(message.CommandArguments()))
+	if lang == "" {
+		msg := tgbotapi.NewMessage(chatID, tr(chatID, "language_choose", translate(chatLanguage(chatID), "language_name")))
+		msg.ReplyMarkup = languageKeyboard()
+		botSend(msg)
+		return
+	}
+	if _, exists := catalogs[lang]; !exists {
+		msg := tgbotapi.NewMessage(chatID, tr(chatID, "language_unknown", lang))
+		msg.ReplyMarkup = languageKeyboard()
+		botSend(msg)
+		return
+	}
+	setLanguage(message.From.ID, lang)
+	botSend(tgbotapi.NewMessage(chatID, translate(lang, "language_set", translate(lang, "language_name"))))
+}
+
+//The language buttons of /language
+func chooseLanguage(query *tgbotapi.CallbackQuery, lang string) {
+	if _, exists := catalogs[lang]; !exists {
+		_, _ = bot.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, ""))
+		return
+	}
+	setLanguage(query.From.ID, lang)
+	_, _ = bot.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, translate(lang, "language_set", translate(lang, "language_name"))))
+	if query.Message != nil {
+		botSend(tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, translate(lang, "language_set", translate(lang, "language_name"))))
+	}
+}
+
+//Save the language which the user has chosen
+func setLanguage(id int, lang string) {
+	updateUser(id, func(u *botUser) {
+		u.Language = lang
+	})
+}
@@ -21,30 +21,79 @@ import (
 )
 
 type config struct {
-	Token     string
-	DBName    string
-	Admins    []int
-	Recaptcha recaptchaConfig `json:"recaptcha"`
+	Token               string
+	DBName              string
+	Store               string //bolt (default), sqlite or memory
+	Admins              []int
+	PoolLowAlert        int              //The admins are alerted when a pool has this many items left; Default is 10
+	TemplateSecret      string           //The secret of the {sig} placeholder of the values
+	ApprovalChat        int64            //The chat which receives the approval requests; Default is the private chat of every admin
+	Recaptcha           recaptchaConfig  `json:"recaptcha"`
+	QR                  qrConfig         `json:"qr"`
+	Backup              backupConfig     `json:"backup"`
+	Encryption          encryptionConfig `json:"encryption"`
+	Ban                 banConfig        `json:"ban"`
+	Send                sendConfig       `json:"send"`
+	Workers             int              //Number of the updates which are handled at the same time; Default is 8
+	WorkerQueue         int              //Number of the updates which can wait for each worker; Default is 64
+	ConversationTimeout int              //Minutes which the bot waits for the answer of a command like /add; Default is 10
+	Locales             string           //Directory of the message catalogs; Default is locales
+	Language            string           //Language of the users whose language has no catalog; Default is en
+	Templates           templatesConfig  `json:"templates"`
 }
 type recaptchaConfig struct {
-	V2         bool
-	PrivateKey string
-	PublicKey  string
-	Domain     string
-	Port       int
-	MinScore   float32
+	V2           bool
+	PrivateKey   string
+	PublicKey    string
+	Domain       string
+	Port         int
+	MinScore     float32
+	CertFile     string //The certificate chain of Domain; Enables HTTPS on Port
+	KeyFile      string
+	RedirectPort int //If set, plain HTTP on this port is redirected to HTTPS; Usually 80
+	PublicPort   int //The port in the links if it is not Port, like when a firewall forwards 443 to Port
+}
+type qrConfig struct {
+	Size    int    //Width of the image in pixels
+	Logo    string //Path of a PNG or JPEG image to put in the center of the code
+	Caption string //Text to write under the code
+}
+type backupConfig struct {
+	Dir        string //Where to save the snapshots; Empty disables the automatic backups
+	Interval   int    //Minutes between the backups; Default is a day
+	KeepDaily  int    //Number of the days to keep their latest snapshot
+	KeepWeekly int    //Number of the weeks to keep their latest snapshot
+	SendTo     int64  //If not zero, the snapshots are sent to this chat as well
+}
+type sendConfig struct {
+	Rate          int //Messages per second to all of the chats; Default is 30
+	ChatInterval  int //Milliseconds between two messages to a private chat; Default is 1000
+	GroupInterval int //Milliseconds between two messages to a group; Default is 3000
+	Retries       int //Number of the retries on network errors; Default is 5
+}
+type banConfig struct {
+	Failures int    //Users are banned after this many failed captchas, passwords or invalid tokens in Window; 0 disables the automatic ban
+	Window   int    //Minutes; Default is 10
+	Duration int    //Minutes of the automatic bans; 0 means forever
+	Message  string //The answer to the banned users
+	Silent   bool   //Do not answer the banned users at all
+}
+type templatesConfig struct {
+	Messages string            //JSON file of the messages to replace; Keys are like welcome or fa.welcome
+	Pages    map[string]string //Files of the parts of the verification page by their name: head, v2, v3, bottom, error and ok
+	Vars     map[string]string //Extra values of the templates like a support contact; Used like {{.Vars.support}}
+}
+type encryptionConfig struct {
+	Key     string   //Base64 or hex of a 32 byte key
+	KeyEnv  string   //Name of an environment variable which contains the key
+	KeyFile string   //Path of a file which contains the key
+	OldKeys []string //Keys which are only used for decrypting; Used for key rotation
 }
 type request struct {
 	CaptchaCode int
 	WantToken   string
-}
-type sPageIn struct {
-	mux sync.Mutex //Nearly everywhere we are writing to PageIn. Also when reading, instantly we write to it
-	//This is a variable to define what "Admins" are going to do; The key is the ID of the admin and the value is the page they want to do. Here is the list of the pages
-	// 0: Nowhere but the main menu; Send the tokens for the link to start verification
-	// 1: Admin whats to add a new text
-	// 2: Admin whats to remove a token
-	PageIn map[int]int
+	Source      string //Where the user came from; Empty if the user did not use a deep link with source
+	User        tgbotapi.User
 }
 type sCaptchaToCheck struct {
 	mux            sync.Mutex //We write to it, or instantly delete it after reading from it; So no need to RWMutex
@@ -60,7 +109,7 @@ type recaptchaResponse struct {
 }
 
 var bot *tgbotapi.BotAPI
-var PageIn sPageIn
+var store Store
 var CaptchaToCheck sCaptchaToCheck
 var Config config
 var ConfigFileName string
@@ -70,45 +119,8 @@ var ConfigFileName string
 //3 is recaptcha v3
 var CaptchaMode = byte(1)
 
-//Web stuff
-const (
-	pageHead = `<html><head>
-	<style>.error{color:#ff0000;} div{margin: auto; text-align: center;} .ack{color:#0000ff;} p{text-align: center;}</style><title>Recaptcha Test</title></head>
-<body><div style="width:100%"><div style="width: 50%;margin: 0 auto;">`
-	pageTopV2 = `<p>Please check the dialog and choose OK after</p><form action="/" method="POST">
-	    <script src="https://www.google.com/recaptcha/api.js"></script>
-		<div style="" class="g-recaptcha" data-sitekey="%s"></div>
-		<input style="display: none" name="chatid" type="text" value="%s">
-		<input style="display: none" name="dbtoken" type="text" value="%s">
-		<div><input type="submit" name="button" value="Ok"></div>
-</form>`
-	pageTopV3 = `<script src="https://www.google.com/recaptcha/api.js?render=%s"></script>
-  	<script>
-  	grecaptcha.ready(function() {
-		grecaptcha.execute('%s', {action: 'homepage'}).then(function(token) {
-			document.getElementById("token").value = token;
-			document.getElementById("myForm").submit();
-		});
-	});
-	</script>
-	<p>Please wait...</p>
-	<form id="myForm" action="/" method="POST">
-	<input style="display: none" id="token" name="g-recaptcha-response" type="text">
-	<input style="display: none" name="chatid" type="text" value="%s">
-	<input style="display: none" name="dbtoken" type="text" value="%s">
-</form>
-	`
-	pageBottom = `</div></div></body></html>`
-	anError    = `<p class="error">%s</p>`
-	anOK       = `<p class="ack">%s</p><script>
-function Redirect() 
-{  
-	window.location="https://telegram.me/%s"; 
-}
-setTimeout('Redirect()', 1000);
-</script>`
-)
-const recaptchaURLLocal = "http://%s:%d/?chatid=%d&dbtoken=%s"
+//Telegram user IDs have at most 52 significant bits
+const maxUserID = 1<<52 - 1
 const recaptchaServerName = "https://www.google.com/recaptcha/api/siteverify"
 const Version = "1.1.2 / Build 6"
 
@@ -117,9 +129,14 @@ func init() {
 }
 
 func main() {
+	var exportFile, importFile, importMode, restoreFile string
 	{ //Parse arguments
 		configFileName := flag.String("config", "config.json", "The config filename")
 		help := flag.Bool("h", false, "Show help")
+		flag.StringVar(&exportFile, "export", "", "Export the database to this file and exit")
+		flag.StringVar(&importFile, "import", "", "Import a file created by -export to the database and exit")
+		flag.StringVar(&importMode, "import-mode", "merge", "merge: keep the existing keys when importing; overwrite: clear the database before importing")
+		flag.StringVar(&restoreFile, "restore", "", "Replace the database with this snapshot before starting")
 		flag.Parse()
 
 		ConfigFileName = *configFileName
@@ -128,7 +145,9 @@ func main() {
 			fmt.Println("Created by Hirbod Behnam")
 			fmt.Println("Source at https://github.com/HirbodBehnam/CaptchaBot")
 			fmt.Println("Version", Version)
+			fmt.Println("Usage: captchabot [flags] [command]")
 			flag.PrintDefaults()
+			fmt.Println(cliUsage)
 			os.Exit(0)
 		}
 	}
@@ -153,23 +172,64 @@ func main() {
 		}
 	}
 
-	//If needed fire up the http server
-	if CaptchaMode != 1 {
-		http.HandleFunc("/", homePage)
-		log.Println("Starting the web server on port", Config.Recaptcha.Port)
-		go func() {
-			if err := http.ListenAndServe(":"+strconv.FormatInt(int64(Config.Recaptcha.Port), 10), nil); err != nil {
-				log.Fatal("failed to start server", err)
-			}
-		}()
+	if err := loadCatalogs(Config.Locales); err != nil {
+		panic("Cannot load the message catalogs: " + err.Error())
+	}
+	if err := loadMessageOverrides(Config.Templates.Messages); err != nil {
+		panic("Cannot load the messages: " + err.Error())
+	}
+	if err := loadPages(Config.Templates.Pages); err != nil {
+		panic("Cannot load the pages: " + err.Error())
+	}
+
+	//Restore the snapshot if needed
+	if restoreFile != "" {
+		if err := RestoreDB(Config.Store, restoreFile, Config.DBName); err != nil {
+			panic("Cannot restore the snapshot: " + err.Error())
+		}
+		log.Println("Restored the database from", restoreFile)
 	}
 
 	//Load db
-	err := LoadDB(Config.DBName)
+	var err error
+	store, err = OpenStore(Config.Store, Config.DBName)
 	if err != nil {
 		panic("Cannot access database: " + err.Error())
 	}
-	defer CloseDB()
+	defer store.Close()
+	store, err = newEncryptedStore(store, Config.Encryption)
+	if err != nil {
+		panic("Cannot load the encryption key: " + err.Error())
+	}
+
+	//Offline backups
+	if exportFile != "" {
+		if err = exportToFile(exportFile); err != nil {
+			log.Println("Cannot export the database:", err.Error())
+		} else {
+			log.Println("Exported the database to", exportFile)
+		}
+		return
+	}
+	if flag.NArg() > 0 { //Run a command without the bot
+		err = runCommand(flag.Args())
+		_ = store.Close()
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if importFile != "" {
+		if importMode != "merge" && importMode != "overwrite" {
+			log.Println("Invalid import mode:", importMode)
+		} else if err = importFromFile(importFile, importMode == "overwrite"); err != nil {
+			log.Println("Cannot import the database:", err.Error())
+		} else {
+			log.Println("Imported", importFile, "to the database")
+		}
+		return
+	}
 
 	//Setup the bot
 	bot, err = tgbotapi.NewBotAPI(Config.Token)
@@ -177,184 +237,165 @@ func main() {
 		panic("Cannot initialize the bot: " + err.Error())
 	}
 
-	//Initialize the Captcha and Page in
+	//Initialize the Captcha
 	CaptchaToCheck.CaptchaToCheck = make(map[int]request)
-	PageIn.PageIn = make(map[int]int)
 
 	log.Printf("Bot authorized on account %s", bot.Self.UserName)
 
+	//If needed fire up the http server; The pages use the bot so it starts after the bot is authorized
+	if CaptchaMode != 1 {
+		go startWebServer()
+	}
+
+	if Config.Backup.Dir != "" {
+		go backupLoop()
+	}
+	go registerBotCommands()
+	go schedulerLoop()
+	go resumeBroadcasts()
+
 	u := tgbotapi.NewUpdate(0)
 	u.Timeout = 60
 
 	updates, err := bot.GetUpdatesChan(u)
 
+	workers := startWorkers(Config.Workers, Config.WorkerQueue)
 	for update := range updates {
-		if update.Message == nil { // ignore any non-Message Updates
-			continue
+		workers.dispatch(update)
+	}
+}
+
+//Handle an update of Telegram; The updates of each user are handled one by one in a worker
+//Long admin tasks like exports run in their own goroutine so they do not hold the worker
+func handleUpdate(update tgbotapi.Update) {
+	if update.CallbackQuery != nil {
+		if isBanned(update.CallbackQuery.From.ID) {
+			_, _ = bot.AnswerCallbackQuery(tgbotapi.NewCallback(update.CallbackQuery.ID, ""))
+			return
 		}
-		//Check if message is command
-		if update.Message.IsCommand() {
-			msg := tgbotapi.NewMessage(update.Message.Chat.ID, "")
-			switch update.Message.Command() {
-			case "start":
-				if strings.Contains(update.Message.Text, " ") { //Check if bot is lunched from deeplink
-					token := strings.Split(update.Message.Text, " ")[1] //This gets the token
-					go processToken(token, update.Message.From.ID, update.Message.Chat.ID)
-					continue
-				}
-				if !checkInArray(update.Message.From.ID, Config.Admins) { //Check admin
-					msg.Text = "Welcome! Please send the token you received to get the text or the link."
-				} else {
-					msg.Text = "Hello!\nYou are the admin of this bot.\nHere is a list of commands:\n\n/add : Use this command to add a link or text. This will later result in a \"token\". Share that token to users to let them receive the text or link.\n/remove : Remove a token\n/list : Lists all of the tokens and values\n/id : Get the ID of anyone that sends it to bot. Can be used to define new admins.\n/about : Just a about screen"
-				}
-			case "add":
-				if !checkInArray(update.Message.From.ID, Config.Admins) { //Check admin
-					log.Println("Unauthorized access from id", update.Message.From.ID, "and username", update.Message.From.UserName, "and name", update.Message.From.FirstName, update.Message.From.LastName)
-					msg.Text = "You are not the admin of this bot!"
-				} else { //User is admin
-					PageIn.mux.Lock()
-					PageIn.PageIn[update.Message.From.ID] = 1
-					PageIn.mux.Unlock()
-					msg.Text = "Please send a text or a link to create a token for it"
-				}
-			case "remove":
-				if !checkInArray(update.Message.From.ID, Config.Admins) { //Check admin
-					log.Println("Unauthorized access from id", update.Message.From.ID, "and username", update.Message.From.UserName, "and name", update.Message.From.FirstName, update.Message.From.LastName)
-					msg.Text = "You are not the admin of this bot!"
-				} else { //User is admin
-					PageIn.mux.Lock()
-					PageIn.PageIn[update.Message.From.ID] = 2
-					PageIn.mux.Unlock()
-					msg.Text = "Please send the token to remove it from database"
-				}
-			case "list":
-				if !checkInArray(update.Message.From.ID, Config.Admins) { //Check admin
-					log.Println("Unauthorized access from id", update.Message.From.ID, "and username", update.Message.From.UserName, "and name", update.Message.From.FirstName, update.Message.From.LastName)
-					msg.Text = "You are not the admin of this bot!"
-				} else { //User is admin
-					go func(id int64) { //Gather all of the links
-						msg := tgbotapi.NewMessage(id, "")
-						list, err := ListAllValues()
-						if err != nil {
-							msg.Text = "Error getting the list: " + err.Error()
-						} else {
-							if len(list) == 0 {
-								msg.Text = "The database is empty!"
-							} else {
-								var sb strings.Builder
-								for k, v := range list {
-									sb.WriteString("`")
-									sb.WriteString(k)
-									sb.WriteString("`")
-									sb.WriteString(" : ")
-									sb.WriteString(v)
-									sb.WriteString("\n")
-								}
-								msg.Text = sb.String()
-								msg.ParseMode = "markdown"
-								msg.DisableWebPagePreview = true
-							}
-						}
-						botSend(msg)
-					}(update.Message.Chat.ID)
-					continue
-				}
-			case "cancel":
-				CaptchaToCheck.mux.Lock()
-				delete(CaptchaToCheck.CaptchaToCheck, update.Message.From.ID)
-				CaptchaToCheck.mux.Unlock()
-				msg.Text = "You can now send a token to bot to access it's data."
-				if checkInArray(update.Message.From.ID, Config.Admins) { //Check admin
-					PageIn.mux.Lock()
-					PageIn.PageIn[update.Message.From.ID] = 0 //Goto nowhere
-					PageIn.mux.Unlock()
-				}
-			case "about":
-				msg.Text = "Made by Hirbod Behnam\nGolang\nSource code at https://github.com/HirbodBehnam/CaptchaBot\nBackend version " + Version
-			case "id": //Send the id to anyone
-				msg.Text = strconv.FormatInt(int64(update.Message.From.ID), 10)
-			default:
-				msg.Text = "I don't know that command"
-			}
-			botSend(msg)
+		processCallback(update.CallbackQuery)
+		return
+	}
+	if update.Message == nil { // ignore any non-Message Updates
+		return
+	}
+	if update.Message.From == nil {
+		return
+	}
+	if isBanned(update.Message.From.ID) {
+		sendBanMessage(update.Message.Chat.ID)
+		return
+	}
+	if update.Message.Chat.IsPrivate() {
+		touchUser(*update.Message.From)
+	}
+	//Check if message is command
+	if update.Message.IsCommand() {
+		routeCommand(update.Message)
+		return
+	}
+	if continueConversation(update.Message) { //The admin is sending what a command asked for
+		return
+	}
+	if processPassword(update.Message) { //The user is sending the password of a token
+		return
+	}
+	//So basically we have 2 scenarios:
+	// 1. The value passed to bot is only numbers: This means that the user is replying to a captcha
+	// 2. The value is letters only: User is requesting a text or link. We shall send him a qr code
+	if a, err := strconv.Atoi(update.Message.Text); err == nil { //Here we have scenario 1; Every thing is a number
+		if CaptchaMode == 1 {
+			processCaptchaAnswer(a, update.Message.Chat.ID, update.Message.From.ID)
 		} else {
-			if checkInArray(update.Message.From.ID, Config.Admins) { //If user is admin...
-				PageIn.mux.Lock()
-				switch PageIn.PageIn[update.Message.From.ID] {
-				case 1: //Admin wants to add a string or link
-					PageIn.PageIn[update.Message.From.ID] = 0
-					PageIn.mux.Unlock()
-					token, err := InsertValue(update.Message.Text)
-					msg := tgbotapi.NewMessage(update.Message.Chat.ID, "")
-					if err != nil {
-						msg.Text = "Error in inserting this string in database: " + err.Error()
-					} else {
-						msg.Text = "Successfully created the text in database!\nThe key is `" + token + "` .\nAlso you can use this link to let the users start the bot directly:\nhttps://telegram.me/" + escapeMarkdown(bot.Self.UserName) + "?start=" + token + "\nShare it with users."
-						msg.ParseMode = "markdown"
-					}
-					botSend(msg)
-					continue //Continue to server other updates
-				case 2: //Admin whats to delete a token
-					PageIn.PageIn[update.Message.From.ID] = 0
-					PageIn.mux.Unlock()
-					err := RemoveKey(update.Message.Text)
-					msg := tgbotapi.NewMessage(update.Message.Chat.ID, "")
-					if err != nil {
-						msg.Text = "Error in deleting this token from database: " + err.Error()
-					} else {
-						msg.Text = "Successfully deleted token `" + update.Message.Text + "` from database."
-						msg.ParseMode = "markdown"
-					}
-					botSend(msg)
-					continue
-				} //Otherwise admin way want to see a link
-				PageIn.mux.Unlock()
-			}
-			//So basically we have 2 scenarios:
-			// 1. The value passed to bot is only numbers: This means that the user is replying to a captcha
-			// 2. The value is letters only: User is requesting a text or link. We shall send him a qr code
-			if a, err := strconv.Atoi(update.Message.Text); err == nil { //Here we have scenario 1; Every thing is a number
-				if CaptchaMode == 1 {
-					go func(userEntry int, chatID int64, id int) {
-						msg := tgbotapi.NewMessage(chatID, "")
-						req := safeReadCaptchaToCheckAndDelete(id)
-						if req.WantToken == "" {
-							msg.Text = "Please send the bot a token first."
-						} else if userEntry == req.CaptchaCode { //Captcha is ok
-							str, err := ReadValue(req.WantToken)
-							if err != nil {
-								msg.Text = "Error retrieving data from database: " + err.Error()
-							} else {
-								msg.Text = str
-							}
-						} else {
-							msg.Text = "Captcha fail. Please try again by sending the _token_ again."
-							msg.ParseMode = "markdown"
-						}
-						botSend(msg)
-					}(a, update.Message.Chat.ID, update.Message.From.ID)
-				} else {
-					msg := tgbotapi.NewMessage(update.Message.Chat.ID, "The token you provided is in valid or does not exists.")
-					botSend(msg)
-				}
-			} else { //Here we have scenario 2; At first try to read it from database
-				go processToken(update.Message.Text, update.Message.From.ID, update.Message.Chat.ID)
-			}
+			msg := tgbotapi.NewMessage(update.Message.Chat.ID, tr(update.Message.Chat.ID, "invalid_token"))
+			botSend(msg)
 		}
+	} else { //Here we have scenario 2; At first try to read it from database
+		processToken(update.Message.Text, "", *update.Message.From, update.Message.Chat.ID)
+	}
+}
+
+//Check the answer of a user to the captcha image
+func processCaptchaAnswer(userEntry int, chatID int64, id int) {
+	msg := tgbotapi.NewMessage(chatID, "")
+	req := safeReadCaptchaToCheckAndDelete(id)
+	if req.WantToken == "" {
+		msg.Text = tr(chatID, "send_token_first")
+	} else if userEntry == req.CaptchaCode { //Captcha is ok
+		logStat(req.WantToken, req.Source, id, statPass)
+		captchaPassed(chatID, req.User, req.WantToken, req.Source)
+		return
+	} else {
+		logStat(req.WantToken, req.Source, id, statFail)
+		recordFailure(id)
+		msg.Text = tr(chatID, "captcha_fail")
+		msg.ParseMode = "markdown"
+	}
+	botSend(msg)
+}
+
+//Handle the inline keyboard buttons
+func processCallback(query *tgbotapi.CallbackQuery) {
+	data := strings.SplitN(query.Data, ":", 2)
+	if len(data) != 2 {
+		_, _ = bot.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, ""))
+		return
+	}
+	switch data[0] { //The buttons of the users
+	case "notify":
+		subscribeRelease(query, data[1])
+		return
+	case "lang":
+		chooseLanguage(query, data[1])
+		return
+	}
+	if !checkInArray(query.From.ID, Config.Admins) || query.Message == nil { //The rest of the buttons are for admins
+		_, _ = bot.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, tr(int64(query.From.ID), "not_admin")))
+		return
+	}
+	_, _ = bot.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, ""))
+	switch data[0] {
+	case "qr":
+		sendQRCode(query.Message.Chat.ID, data[1], "")
+	case "approve", "deny":
+		decideApproval(query, data[1], data[0] == "approve")
+	case "cmd":
+		runMenuCommand(query, data[1])
 	}
 }
 
-//Just handle errors here
-func botSend(message tgbotapi.Chattable) {
-	_, err := bot.Send(message)
+//Send the QR code of a token to a chat as a PNG file
+func sendQRCode(chatID int64, token, source string) {
+	qr, err := TokenQRCode(token, source)
 	if err != nil {
-		log.Println("Error on sending a message:", err.Error())
+		log.Println("Error on creating QR code:", err.Error())
+		botSend(tgbotapi.NewMessage(chatID, "Error on creating QR code: "+err.Error()))
+		return
 	}
+	name := token
+	if source != "" {
+		name += "-" + source
+	}
+	msg := tgbotapi.NewDocumentUpload(chatID, tgbotapi.FileBytes{Bytes: qr, Name: name + ".png"})
+	msg.Caption = deepLink(token, source)
+	botSend(msg)
 }
 
 //Generate the captcha
-func processToken(token string, id int, chatID int64) { //This function will be always called with go
-	if HasKey(token) {
+func processToken(token, source string, user tgbotapi.User, chatID int64) {
+	id := user.ID
+	if store.HasKey(token) {
+		logStat(token, source, id, statRequest)
+		if meta, err := store.ReadMeta(token); err != nil {
+			botSend(tgbotapi.NewMessage(chatID, tr(chatID, "database_error", err.Error())))
+			return
+		} else if time.Now().Before(meta.NotBefore) {
+			sendCountdown(chatID, token, meta.NotBefore)
+			return
+		} else if err = meta.check(); err != nil {
+			botSend(tgbotapi.NewMessage(chatID, revealError(chatID, token, err)))
+			return
+		}
 		//Prepare the QR Code
 		switch CaptchaMode {
 		case 1: //Send a normal captcha
@@ -366,32 +407,40 @@ func processToken(token string, id int, chatID int64) { //This function will be
 					numDigits += int(digits[i])
 				}
 				CaptchaToCheck.mux.Lock()
-				CaptchaToCheck.CaptchaToCheck[id] = request{numDigits, token}
+				CaptchaToCheck.CaptchaToCheck[id] = request{numDigits, token, source, user}
 				CaptchaToCheck.mux.Unlock()
 			}
 			qrImage := captcha.NewImage(strconv.FormatInt(int64(id), 10), digits, 200, 100)
 			var buf bytes.Buffer
 			if err := jpeg.Encode(&buf, qrImage.Paletted, nil); err != nil {
-				msg := tgbotapi.NewMessage(chatID, "Error on encoding captcha.")
+				msg := tgbotapi.NewMessage(chatID, tr(chatID, "captcha_error"))
 				log.Println("Error on encoding captcha.", err.Error())
 				botSend(msg)
 				return
 			}
 			file := tgbotapi.FileBytes{Bytes: buf.Bytes(), Name: strconv.FormatInt(int64(id), 10)}
 			msg := tgbotapi.NewPhotoUpload(chatID, file)
-			msg.Caption = "Please enter the number in this image\n/cancel to turn back"
+			msg.Caption = trToken(chatID, token, "captcha_image")
 			botSend(msg)
 		case 2:
-			msg := tgbotapi.NewMessage(chatID, "Open this url and complete the captcha:\n"+fmt.Sprintf(recaptchaURLLocal, Config.Recaptcha.Domain, Config.Recaptcha.Port, chatID, token))
+			//Remember the user for the web page
+			CaptchaToCheck.mux.Lock()
+			CaptchaToCheck.CaptchaToCheck[id] = request{0, token, source, user}
+			CaptchaToCheck.mux.Unlock()
+			msg := tgbotapi.NewMessage(chatID, trToken(chatID, token, "open_v2", pageURL(chatID, token, source)))
 			msg.DisableWebPagePreview = true
 			botSend(msg)
 		case 3:
-			msg := tgbotapi.NewMessage(chatID, "Open this url and wait:\n"+fmt.Sprintf(recaptchaURLLocal, Config.Recaptcha.Domain, Config.Recaptcha.Port, chatID, token))
+			CaptchaToCheck.mux.Lock()
+			CaptchaToCheck.CaptchaToCheck[id] = request{0, token, source, user}
+			CaptchaToCheck.mux.Unlock()
+			msg := tgbotapi.NewMessage(chatID, trToken(chatID, token, "open_v3", pageURL(chatID, token, source)))
 			msg.DisableWebPagePreview = true
 			botSend(msg)
 		}
 	} else { //The link is broken
-		msg := tgbotapi.NewMessage(chatID, "The token you provided is in valid or does not exists.")
+		recordFailure(id)
+		msg := tgbotapi.NewMessage(chatID, trToken(chatID, token, "invalid_token"))
 		botSend(msg)
 	}
 }
@@ -406,41 +455,83 @@ func processRequest(request *http.Request) bool {
 	if CaptchaMode == 2 {
 		return result.Success
 	} else {
-		return result.Score >= Config.Recaptcha.MinScore
+		return result.Success && result.Score >= Config.Recaptcha.MinScore
 	}
 }
 
 //Load the page
+//The inputs are validated before anything is shown; They are only put in the page by html/template
 func homePage(writer http.ResponseWriter, request *http.Request) {
-	err := request.ParseForm() // Must be called before writing response
-	id := request.FormValue("chatid")
+	if request.URL.Path != "/" {
+		http.NotFound(writer, request)
+		return
+	}
+	if request.Method != http.MethodGet && request.Method != http.MethodPost {
+		writer.Header().Set("Allow", "GET, POST")
+		http.Error(writer, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	err := request.ParseForm()
 	token := request.FormValue("dbtoken")
-	fmt.Fprint(writer, pageHead)
-	if err != nil {
-		fmt.Fprintf(writer, fmt.Sprintf(anError, err))
-	} else {
-		_, buttonClicked := request.Form["g-recaptcha-response"]
-		if buttonClicked {
-			if processRequest(request) {
-				a, _ := strconv.Atoi(id)
-				fmt.Fprint(writer, fmt.Sprintf(anOK, "Sent the code via telegram!", bot.Self.UserName))
-				go sendValueWithBot(int64(a), token)
-			} else {
-				if CaptchaMode == 2 {
-					fmt.Fprintf(writer, fmt.Sprintf(anError, "Recaptcha was incorrect; try again."))
-				} else {
-					fmt.Fprintf(writer, fmt.Sprintf(anError, "Unfortunately you are not worthy enough to access this right now."))
-				}
-			}
+	source := request.FormValue("source")
+	if !validSource(source) {
+		source = ""
+	}
+	chatID, idErr := strconv.ParseInt(request.FormValue("chatid"), 10, 64)
+	if err != nil || idErr != nil || chatID <= 0 || chatID > maxUserID || !validKey(token) { //Users are private chats with positive IDs
+		data := newPageData(0, "", "")
+		data.Message = data.T("page_bad_request")
+		writePage(writer, http.StatusBadRequest, "error", data)
+		return
+	}
+	data := newPageData(chatID, token, source)
+	if isBanned(int(chatID)) {
+		data.Message = data.T("banned")
+		writePage(writer, http.StatusForbidden, "error", data)
+		return
+	}
+	if !store.HasKey(token) {
+		data.Message = data.T("invalid_token")
+		writePage(writer, http.StatusNotFound, "error", data)
+		return
+	}
+	if _, buttonClicked := request.Form["g-recaptcha-response"]; !buttonClicked {
+		if CaptchaMode == 2 {
+			writePage(writer, http.StatusOK, "v2", data)
 		} else {
-			if CaptchaMode == 2 {
-				fmt.Fprint(writer, fmt.Sprintf(pageTopV2, Config.Recaptcha.PublicKey, id, token))
-			} else {
-				fmt.Fprint(writer, fmt.Sprintf(pageTopV3, Config.Recaptcha.PublicKey, Config.Recaptcha.PublicKey, id, token))
-			}
+			writePage(writer, http.StatusOK, "v3", data)
+		}
+		return
+	}
+	id := int(chatID)
+	//Anyone can post any chat ID; Only the users who asked for this token in the bot can pass
+	if !hasPendingCaptcha(id, token) {
+		data.Message = data.T("page_bad_request")
+		writePage(writer, http.StatusForbidden, "error", data)
+		return
+	}
+	if !processRequest(request) {
+		logStat(token, source, id, statFail)
+		recordFailure(id)
+		if CaptchaMode == 2 {
+			data.Message = data.T("page_wrong_v2")
+		} else {
+			data.Message = data.T("page_wrong_v3")
 		}
+		writePage(writer, http.StatusForbidden, "error", data)
+		return
 	}
-	fmt.Fprint(writer, pageBottom)
+	//Two passes may be posted at once; Only the one which takes the request sends the value
+	req, pending := takePendingCaptcha(id, token)
+	if !pending {
+		data.Message = data.T("page_bad_request")
+		writePage(writer, http.StatusForbidden, "error", data)
+		return
+	}
+	logStat(token, source, id, statPass)
+	data.Message = data.T("page_sent")
+	writePage(writer, http.StatusOK, "ok", data)
+	go captchaPassed(chatID, req.User, token, source)
 }
 func checkRecaptcha(remoteip, response string) (r recaptchaResponse, err error) {
 	resp, err := http.PostForm(recaptchaServerName,
@@ -452,27 +543,129 @@ func checkRecaptcha(remoteip, response string) (r recaptchaResponse, err error)
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Println("Read error: could not read body: %s", err)
+		log.Println("Read error: could not read body:", err)
 		return
 	}
 	err = json.Unmarshal(body, &r)
 	if err != nil {
-		log.Println("Read error: got invalid JSON: %s", err)
+		log.Println("Read error: got invalid JSON:", err)
 		return
 	}
 	return
 }
 
 //Gets a value from database and sends it to bot
-func sendValueWithBot(id int64, token string) {
-	value, err := ReadValue(token)
-	msg := tgbotapi.NewMessage(id, "")
-	if err == nil {
-		msg.Text = value
+func sendValueWithBot(id int64, user tgbotapi.User, token string) {
+	value, meta, err := revealValue(token, user)
+	if err != nil {
+		botSend(tgbotapi.NewMessage(id, revealError(id, token, err)))
+		return
+	}
+	sendValue(id, value, meta)
+	registerReveal(user.ID, token)
+}
+
+//Send a revealed value with the options of its token and schedule its deletion
+func sendValue(chatID int64, value string, meta tokenMeta) {
+	if meta.DeleteAfter > 0 {
+		value += tr(chatID, "delete_notice", meta.deleteDelay().String())
+	}
+	var sent tgbotapi.Message
+	var err error
+	if meta.Protect { //The library does not support protect_content so the request is made by hand
+		sent, err = botRequestWait(chatID, "sendMessage", url.Values{
+			"chat_id":         {strconv.FormatInt(chatID, 10)},
+			"text":            {value},
+			"protect_content": {"true"},
+		})
 	} else {
-		msg.Text = "Error getting value from database: " + err.Error()
+		sent, err = botSendWait(tgbotapi.NewMessage(chatID, value))
 	}
-	botSend(msg)
+	if err != nil { //The error is logged by the send queue
+		return
+	}
+	if meta.DeleteAfter > 0 {
+		err = scheduleJob(time.Now().Add(meta.deleteDelay()), jobDeleteMessage, deleteMessageJob{ChatID: chatID, MessageID: sent.MessageID})
+		if err != nil {
+			log.Println("Cannot schedule the deletion of a message:", err.Error())
+		}
+	}
+}
+
+//Get the value of a token for a user; Users of pools get their own item
+//The placeholders of the value are replaced with the information of the user
+func revealValue(token string, user tgbotapi.User) (string, tokenMeta, error) {
+	meta, err := store.ReadMeta(token)
+	if err != nil {
+		return "", meta, err
+	}
+	var value string
+	if meta.Pool {
+		value, err = claimPoolItem(token, user.ID)
+	} else {
+		value, err = store.RevealValue(token)
+	}
+	if err != nil {
+		return "", meta, err
+	}
+	return renderValue(value, token, user), meta, nil
+}
+
+//Record a stat and log the errors
+func logStat(token, source string, user int, event statEvent) {
+	if err := store.RecordStat(token, source, user, event); err != nil {
+		log.Println("Cannot record stats:", err.Error())
+	}
+}
+
+//Create a deep link to the bot for a token; Source is optional and will be appended to the token
+func deepLink(token, source string) string {
+	if source != "" {
+		token += "-" + source
+	}
+	return "https://telegram.me/" + bot.Self.UserName + "?start=" + token
+}
+
+//Split the deep link payload to token and source. Payloads are like <token> or <token>-<source>
+func splitPayload(payload string) (string, string) {
+	i := strings.Index(payload, "-")
+	if i == -1 {
+		return payload, ""
+	}
+	if !validSource(payload[i+1:]) {
+		return payload[:i], ""
+	}
+	return payload[:i], payload[i+1:]
+}
+
+//Telegram only allows A-Z, a-z, 0-9, _ and - in deep links; The 64 characters limit is for the whole payload
+const maxSourceLength = 32
+
+func validSource(source string) bool {
+	if source == "" || len(source) > maxSourceLength {
+		return false
+	}
+	for _, c := range source {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+//The message which is sent to users when RevealValue fails
+func revealError(chatID int64, token string, err error) string {
+	switch err {
+	case errTokenExpired:
+		return trToken(chatID, token, "token_expired")
+	case errTokenUsedUp:
+		return trToken(chatID, token, "token_used_up")
+	case errPoolEmpty:
+		return trToken(chatID, token, "pool_empty")
+	case errNotReleased:
+		return trToken(chatID, token, "not_released")
+	}
+	return trToken(chatID, token, "database_error", err.Error())
 }
 
 //With mutex, read the captcha from CaptchaToCheck and delete the value after
@@ -484,6 +677,26 @@ func safeReadCaptchaToCheckAndDelete(id int) request {
 	return res
 }
 
+//Check if a user has asked for a token and has not passed its captcha yet
+func hasPendingCaptcha(id int, token string) bool {
+	CaptchaToCheck.mux.Lock()
+	req, exists := CaptchaToCheck.CaptchaToCheck[id]
+	CaptchaToCheck.mux.Unlock()
+	return exists && req.WantToken == token
+}
+
+//Remove the request of a user if it is for this token; The second value is false if there was no such request
+func takePendingCaptcha(id int, token string) (request, bool) {
+	CaptchaToCheck.mux.Lock()
+	defer CaptchaToCheck.mux.Unlock()
+	req, exists := CaptchaToCheck.CaptchaToCheck[id]
+	if !exists || req.WantToken != token {
+		return request{}, false
+	}
+	delete(CaptchaToCheck.CaptchaToCheck, id)
+	return req, true
+}
+
 //A small function to check if an array contains a key
 func checkInArray(value int, array []int) bool {
 	for _, i := range array {
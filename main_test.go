@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitPayload(t *testing.T) {
+	tests := []struct {
+		payload, token, source string
+	}{
+		{"", "", ""},
+		{"abcDEF", "abcDEF", ""},
+		{"abcDEF-youtube", "abcDEF", "youtube"},
+		{"abcDEF-you_tube2", "abcDEF", "you_tube2"},
+		{"abcDEF-", "abcDEF", ""},
+		{"abcDEF-a-b", "abcDEF", ""},
+		{"abcDEF-bad source", "abcDEF", ""},
+		{"abcDEF-" + strings.Repeat("s", maxSourceLength), "abcDEF", strings.Repeat("s", maxSourceLength)},
+		{"abcDEF-" + strings.Repeat("s", maxSourceLength+1), "abcDEF", ""},
+		{"-youtube", "", "youtube"},
+	}
+	for _, test := range tests {
+		token, source := splitPayload(test.payload)
+		if token != test.token || source != test.source {
+			t.Errorf("splitPayload(%q) = %q, %q; want %q, %q", test.payload, token, source, test.token, test.source)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/url"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+//The commands in the admin menu of /start; Each slice is a row of buttons
+var adminMenuRows = [][]string{
+	{"add", "bulk", "pool"},
+	{"list", "stats", "broadcast"},
+	{"export", "backup", "ban"},
+}
+
+//A command in setMyCommands
+type botCommand struct {
+	Command     string `json:"command"`
+	Description string `json:"description"`
+}
+
+//The inline keyboard of the admin menu; The buttons run the commands without arguments
+func adminMenu() tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, names := range adminMenuRows {
+		var row []tgbotapi.InlineKeyboardButton
+		for _, name := range names {
+			row = append(row, tgbotapi.NewInlineKeyboardButtonData(strings.Title(name), "cmd:"+name))
+		}
+		rows = append(rows, row)
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+//Run a command of the admin menu as if the admin had sent it
+func runMenuCommand(query *tgbotapi.CallbackQuery, name string) {
+	cmd, exists := commands[name]
+	if !exists {
+		return
+	}
+	cmd.handler(&tgbotapi.Message{From: query.From, Chat: query.Message.Chat, Text: "/" + name})
+}
+
+//Register the command lists of the bot. Users only see their commands and each admin sees all of them
+//The commands of the users are registered in every loaded language as well
+func registerBotCommands() {
+	var adminCommands []botCommand
+	for _, cmd := range commandList {
+		adminCommands = append(adminCommands, botCommand{cmd.name, cmd.description})
+	}
+	defaultScope := map[string]interface{}{"type": "default"}
+	setBotCommands(userCommands(pickLanguage()), defaultScope, "")
+	for _, lang := range languages() {
+		setBotCommands(userCommands(lang), defaultScope, lang)
+	}
+	for _, admin := range Config.Admins {
+		setBotCommands(adminCommands, map[string]interface{}{"type": "chat", "chat_id": admin}, "")
+	}
+}
+
+//The commands of the users with their descriptions in a language
+func userCommands(lang string) []botCommand {
+	var list []botCommand
+	for _, cmd := range commandList {
+		if !cmd.admin {
+			list = append(list, botCommand{cmd.name, translate(lang, "command_"+cmd.name)})
+		}
+	}
+	return list
+}
+
+//Set the commands of a scope; Empty languageCode sets them for the users without a dedicated list
+func setBotCommands(list []botCommand, scope map[string]interface{}, languageCode string) {
+	commandsJSON, _ := json.Marshal(list)
+	scopeJSON, _ := json.Marshal(scope)
+	params := url.Values{"commands": {string(commandsJSON)}, "scope": {string(scopeJSON)}}
+	if languageCode != "" {
+		params.Set("language_code", languageCode)
+	}
+	_, err := bot.MakeRequest("setMyCommands", params)
+	if err != nil {
+		log.Println("Cannot set the commands of scope", string(scopeJSON), ":", err.Error())
+	}
+}
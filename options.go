@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+//Telegram does not let the bots delete the messages which are older than 48 hours
+const maxDeleteAfter = 48 * time.Hour
+
+//The help of the options which admins can set on /add and /set
+const optionsHelp = "Options are written like `name=value` and separated with spaces:\n" +
+	"`expire` : A time like `2006-01-02T15:04` or a duration like `72h`; `never` removes it\n" +
+	"`limit` : The number of times that the value can be revealed; `0` means unlimited\n" +
+	"`delete` : Delete the value from the chat of the user after a duration like `30s` or `10m`; `off` disables it\n" +
+	"`protect` : `on` stops the users from forwarding or saving the value\n" +
+	"`password` : Users must send this password after the captcha; `off` removes it. It must be the last option and takes the rest of the line so it can have spaces\n" +
+	"`approval` : `on` sends every request to the admins to approve it before sending the value\n" +
+	"`release` : The token cannot be revealed before this time like `2006-01-02T15:04`; `now` removes it"
+
+//Split the options of a command on spaces; The password is the rest of the text so it can have spaces
+func splitOptions(text string) []string {
+	var options []string
+	text = strings.TrimSpace(text)
+	for text != "" {
+		if strings.HasPrefix(strings.ToLower(text), "password=") {
+			return append(options, text)
+		}
+		i := strings.IndexFunc(text, unicode.IsSpace)
+		if i == -1 {
+			return append(options, text)
+		}
+		options = append(options, text[:i])
+		text = strings.TrimLeftFunc(text[i:], unicode.IsSpace)
+	}
+	return options
+}
+
+//Apply the options like "delete=30s protect=on" on the metadata of a token
+func applyOptions(meta *tokenMeta, options []string) error {
+	for _, option := range options {
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return fmt.Errorf("invalid option %q; use name=value", option)
+		}
+		name, value := strings.ToLower(parts[0]), parts[1]
+		switch name {
+		case "expire":
+			if value == "never" {
+				meta.Expire = time.Time{}
+				continue
+			}
+			expire, err := parseTime(value)
+			if err != nil {
+				return err
+			}
+			meta.Expire = expire
+		case "limit":
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit < 0 {
+				return fmt.Errorf("invalid limit %q", value)
+			}
+			meta.MaxUses = limit
+		case "delete":
+			if value == "off" || value == "0" {
+				meta.DeleteAfter = 0
+				continue
+			}
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				if seconds, err2 := strconv.Atoi(value); err2 == nil {
+					d, err = time.Duration(seconds)*time.Second, nil
+				}
+			}
+			if err != nil || d < time.Second || d > maxDeleteAfter {
+				return fmt.Errorf("invalid delete delay %q; use a duration between 1s and %s", value, maxDeleteAfter)
+			}
+			meta.DeleteAfter = int(d / time.Second)
+		case "protect":
+			enabled, err := parseSwitch(value)
+			if err != nil {
+				return err
+			}
+			meta.Protect = enabled
+		case "password":
+			if value == "off" {
+				meta.PasswordHash = ""
+				continue
+			}
+			hash, err := hashPassword(value)
+			if err != nil {
+				return err
+			}
+			meta.PasswordHash = hash
+		case "release":
+			if value == "now" {
+				meta.NotBefore = time.Time{}
+				continue
+			}
+			release, err := parseTime(value)
+			if err != nil {
+				return err
+			}
+			meta.NotBefore = release
+		case "approval":
+			enabled, err := parseSwitch(value)
+			if err != nil {
+				return err
+			}
+			meta.Approval = enabled
+		default:
+			return fmt.Errorf("unknown option %q", name)
+		}
+	}
+	return nil
+}
+
+//Parse the value of the options which are on or off
+func parseSwitch(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "on", "yes", "true":
+		return true, nil
+	case "off", "no", "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid value %q; use on or off", value)
+}
+
+//On or off
+func switchText(enabled bool) string {
+	if enabled {
+		return "on"
+	}
+	return "off"
+}
+
+//The options of a token in the format which applyOptions accepts; The password is only shown as set
+func (meta tokenMeta) optionsText() string {
+	expire := "never"
+	if !meta.Expire.IsZero() {
+		expire = meta.Expire.Format("2006-01-02T15:04")
+	}
+	deleteAfter := "off"
+	if meta.DeleteAfter > 0 {
+		deleteAfter = meta.deleteDelay().String()
+	}
+	password := "off"
+	if meta.PasswordHash != "" {
+		password = "set"
+	}
+	release := "now"
+	if !meta.NotBefore.IsZero() {
+		release = meta.NotBefore.Format("2006-01-02T15:04")
+	}
+	return fmt.Sprintf("expire=%s limit=%d delete=%s protect=%s password=%s approval=%s release=%s",
+		expire, meta.MaxUses, deleteAfter, switchText(meta.Protect), password, switchText(meta.Approval), release)
+}
+
+func (meta tokenMeta) deleteDelay() time.Duration {
+	return time.Duration(meta.DeleteAfter) * time.Second
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestApplyOptions(t *testing.T) {
+	release := time.Date(2030, 1, 2, 15, 4, 0, 0, time.Local)
+	start := tokenMeta{MaxUses: 5, DeleteAfter: 30, Protect: true, Approval: true, Expire: release, NotBefore: release}
+	tests := []struct {
+		options []string
+		want    func(meta tokenMeta) bool //Nil if the options are invalid
+	}{
+		{nil, func(m tokenMeta) bool { return reflect.DeepEqual(m, start) }},
+		{[]string{"limit=3"}, func(m tokenMeta) bool { return m.MaxUses == 3 }},
+		{[]string{"LIMIT=0"}, func(m tokenMeta) bool { return m.MaxUses == 0 }},
+		{[]string{"limit=-1"}, nil},
+		{[]string{"limit=many"}, nil},
+		{[]string{"delete=10m"}, func(m tokenMeta) bool { return m.DeleteAfter == 600 }},
+		{[]string{"delete=45"}, func(m tokenMeta) bool { return m.DeleteAfter == 45 }},
+		{[]string{"delete=off"}, func(m tokenMeta) bool { return m.DeleteAfter == 0 }},
+		{[]string{"delete=0"}, func(m tokenMeta) bool { return m.DeleteAfter == 0 }},
+		{[]string{"delete=500ms"}, nil},
+		{[]string{"delete=49h"}, nil},
+		{[]string{"protect=off", "approval=no"}, func(m tokenMeta) bool { return !m.Protect && !m.Approval }},
+		{[]string{"protect=maybe"}, nil},
+		{[]string{"expire=never"}, func(m tokenMeta) bool { return m.Expire.IsZero() }},
+		{[]string{"expire=72h"}, func(m tokenMeta) bool { return time.Until(m.Expire).Round(time.Hour) == 72*time.Hour }},
+		{[]string{"expire=2031-05-06T07:08"}, func(m tokenMeta) bool {
+			return m.Expire.Equal(time.Date(2031, 5, 6, 7, 8, 0, 0, time.Local))
+		}},
+		{[]string{"expire=tomorrow"}, nil},
+		{[]string{"release=now"}, func(m tokenMeta) bool { return m.NotBefore.IsZero() }},
+		{[]string{"release=2031-05-06 07:08"}, func(m tokenMeta) bool {
+			return m.NotBefore.Equal(time.Date(2031, 5, 6, 7, 8, 0, 0, time.Local))
+		}},
+		{[]string{"password=off"}, func(m tokenMeta) bool { return m.PasswordHash == "" }},
+		{[]string{"limit"}, nil},
+		{[]string{"limit="}, nil},
+		{[]string{"color=red"}, nil},
+	}
+	for _, test := range tests {
+		meta := start
+		err := applyOptions(&meta, test.options)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("applyOptions(%q) accepted invalid options", test.options)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("applyOptions(%q) = %v", test.options, err)
+		} else if !test.want(meta) {
+			t.Errorf("applyOptions(%q) gave %+v", test.options, meta)
+		}
+	}
+}
+
+func TestSplitOptions(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"", nil},
+		{"  ", nil},
+		{"limit=3", []string{"limit=3"}},
+		{" limit=3   protect=on ", []string{"limit=3", "protect=on"}},
+		{"limit=3 password=open sesame  now", []string{"limit=3", "password=open sesame  now"}},
+		{"PASSWORD=a b", []string{"PASSWORD=a b"}},
+		{"token limit=3\tpassword=x", []string{"token", "limit=3", "password=x"}},
+	}
+	for _, test := range tests {
+		if got := splitOptions(test.text); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitOptions(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestPassword(t *testing.T) {
+	var meta tokenMeta
+	if err := applyOptions(&meta, splitOptions("limit=2 password=open sesame")); err != nil {
+		t.Fatal(err)
+	}
+	if meta.PasswordHash == "" {
+		t.Fatalf("the password is not saved: %+v", meta)
+	}
+	for password, want := range map[string]bool{"open sesame": true, "open": false, "open sesame ": false, "": false} {
+		if got := meta.checkPassword(password); got != want {
+			t.Errorf("checkPassword(%q) = %v, want %v", password, got, want)
+		}
+	}
+	if err := applyOptions(&meta, []string{"password=off"}); err != nil || meta.PasswordHash != "" || !meta.checkPassword("anything") {
+		t.Errorf("password=off did not remove the password: %v %+v", err, meta)
+	}
+	if err := applyOptions(&meta, []string{"password=" + string(make([]byte, 73))}); err == nil {
+		t.Error("a password longer than 72 bytes is accepted")
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+//The parts of the verification page; Each of them can be replaced with a file in Config.Templates.Pages
+//The texts are translated with the language of the chat; Use {{.T "key"}} to show a message of the catalogs
+//Scripts only run with the nonce of the page because of pageCSP; Use <script nonce="{{.Nonce}}">
+const (
+	pageHead = `<html lang="{{.Lang}}" dir="{{.T "direction"}}"><head>
+	<style>.error{color:#ff0000;} div{margin: auto; text-align: center;} .ack{color:#0000ff;} p{text-align: center;}</style><title>{{.T "page_title"}}</title></head>
+<body><div style="width:100%"><div style="width: 50%;margin: 0 auto;">`
+	pageTopV2 = `<p>{{.T "page_check"}}</p><form action="/" method="POST">
+	    <script nonce="{{.Nonce}}" src="https://www.google.com/recaptcha/api.js"></script>
+		<div style="" class="g-recaptcha" data-sitekey="{{.SiteKey}}"></div>
+		<input style="display: none" name="chatid" type="text" value="{{.ChatID}}">
+		<input style="display: none" name="dbtoken" type="text" value="{{.Token}}">
+		<input style="display: none" name="source" type="text" value="{{.Source}}">
+		<div><input type="submit" name="button" value="{{.T "page_button"}}"></div>
+</form>`
+	pageTopV3 = `<script nonce="{{.Nonce}}" src="https://www.google.com/recaptcha/api.js?render={{.SiteKey}}"></script>
+  	<script nonce="{{.Nonce}}">
+  	grecaptcha.ready(function() {
+		grecaptcha.execute({{.SiteKey}}, {action: 'homepage'}).then(function(token) {
+			document.getElementById("token").value = token;
+			document.getElementById("myForm").submit();
+		});
+	});
+	</script>
+	<p>{{.T "page_wait"}}</p>
+	<form id="myForm" action="/" method="POST">
+	<input style="display: none" id="token" name="g-recaptcha-response" type="text">
+	<input style="display: none" name="chatid" type="text" value="{{.ChatID}}">
+	<input style="display: none" name="dbtoken" type="text" value="{{.Token}}">
+	<input style="display: none" name="source" type="text" value="{{.Source}}">
+</form>
+	`
+	pageBottom = `</div></div></body></html>`
+	anError    = `<p class="error">{{.Message}}</p>`
+	anOK       = `<p class="ack">{{.Message}}</p><script nonce="{{.Nonce}}">
+function Redirect()
+{
+	window.location="https://telegram.me/{{.BotUserName}}";
+}
+setTimeout(Redirect, 1000);
+</script>`
+)
+
+//The Content-Security-Policy of the pages; %s is the nonce
+const pageCSP = "default-src 'self'; script-src 'nonce-%s' 'strict-dynamic' https://www.google.com/recaptcha/ https://www.gstatic.com/recaptcha/; " +
+	"frame-src https://www.google.com/recaptcha/ https://recaptcha.google.com/recaptcha/; style-src 'self' 'unsafe-inline'; img-src 'self' https: data:; " +
+	"form-action 'self'; frame-ancestors 'none'; base-uri 'none'; object-src 'none'"
+
+//The names of the parts in Config.Templates.Pages
+var builtinPages = map[string]string{
+	"head":   pageHead,
+	"v2":     pageTopV2,
+	"v3":     pageTopV3,
+	"bottom": pageBottom,
+	"error":  anError,
+	"ok":     anOK,
+}
+
+//The data of the page templates
+type pageData struct {
+	Lang        string
+	BotName     string
+	BotUserName string
+	SiteKey     string
+	ChatID      string
+	Token       string
+	Source      string
+	FirstName   string //Empty if the user is unknown or has not asked for the token
+	UserName    string
+	Message     string //The text of error and ok
+	Nonce       string //The nonce of the scripts; A new one for each page
+	Vars        map[string]string
+}
+
+//A message of the catalogs in the language of the page
+func (d pageData) T(key string) string {
+	return translate(d.Lang, key)
+}
+
+var pages *template.Template
+
+//Parse the built in parts of the page and replace them with the files of the config
+func loadPages(files map[string]string) error {
+	pages = template.New("page")
+	for name, text := range builtinPages {
+		if _, err := pages.New(name).Parse(text); err != nil {
+			return fmt.Errorf("could not parse the %s page: %v", name, err)
+		}
+	}
+	for name, file := range files {
+		if _, exists := builtinPages[name]; !exists {
+			return fmt.Errorf("unknown page %q; it must be one of head, v2, v3, bottom, error and ok", name)
+		}
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("could not read %s: %v", file, err)
+		}
+		if _, err = pages.New(name).Parse(string(b)); err != nil {
+			return fmt.Errorf("could not parse %s: %v", file, err)
+		}
+	}
+	return nil
+}
+
+//The data of the pages of a chat; The user is only filled if they have asked the bot for this token
+//so nobody can see the name or the language of a user by putting their ID in the link
+func newPageData(chatID int64, token, source string) pageData {
+	var u botUser
+	if hasPendingCaptcha(int(chatID), token) {
+		u = chatUser(chatID)
+	}
+	return pageData{
+		Lang:        pickLanguage(u.Language, u.LanguageCode),
+		BotName:     bot.Self.FirstName,
+		BotUserName: bot.Self.UserName,
+		SiteKey:     Config.Recaptcha.PublicKey,
+		ChatID:      fmt.Sprint(chatID),
+		Token:       token,
+		Source:      source,
+		FirstName:   u.FirstName,
+		UserName:    u.UserName,
+		Vars:        Config.Templates.Vars,
+		Nonce:       newNonce(),
+	}
+}
+
+//A random nonce for the scripts of a page
+func newNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("cannot generate the nonce: " + err.Error())
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+//Write a whole page with the security headers; part is the part between head and bottom
+//The page is rendered before anything is written so a broken template does not leave half a page
+func writePage(writer http.ResponseWriter, status int, part string, data pageData) {
+	var buf bytes.Buffer
+	for _, name := range []string{"head", part, "bottom"} {
+		if err := pages.ExecuteTemplate(&buf, name, data); err != nil {
+			log.Println("Cannot render the", name, "page:", err.Error())
+			http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	header := writer.Header()
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("Content-Security-Policy", fmt.Sprintf(pageCSP, data.Nonce))
+	header.Set("X-Frame-Options", "DENY")
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Referrer-Policy", "no-referrer") //The links have the chat ID and the token
+	header.Set("Cache-Control", "no-store")
+	if useTLS() {
+		header.Set("Strict-Transport-Security", "max-age=31536000")
+	}
+	writer.WriteHeader(status)
+	_, _ = buf.WriteTo(writer)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+//Prepare the globals which the verification page uses; The store is a new memory store
+func setupPages(t *testing.T) string {
+	t.Helper()
+	bot = &tgbotapi.BotAPI{Self: tgbotapi.User{FirstName: "Test", UserName: "testbot"}}
+	store = newMemoryStore()
+	CaptchaMode = 2
+	CaptchaToCheck.CaptchaToCheck = make(map[int]request)
+	if err := loadPages(nil); err != nil {
+		t.Fatal(err)
+	}
+	token, err := store.InsertValue("value", tokenMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestHomePageValidation(t *testing.T) {
+	token := setupPages(t)
+	tests := []struct {
+		name   string
+		method string
+		target string
+		status int
+	}{
+		{"valid", "GET", "/?chatid=1234&dbtoken=" + token, http.StatusOK},
+		{"ID above int32", "GET", "/?chatid=5000000000&dbtoken=" + token, http.StatusOK},
+		{"largest ID", "GET", "/?chatid=4503599627370495&dbtoken=" + token, http.StatusOK},
+		{"ID above 52 bits", "GET", "/?chatid=4503599627370496&dbtoken=" + token, http.StatusBadRequest},
+		{"negative ID", "GET", "/?chatid=-100&dbtoken=" + token, http.StatusBadRequest},
+		{"text ID", "GET", "/?chatid=abc&dbtoken=" + token, http.StatusBadRequest},
+		{"no ID", "GET", "/?dbtoken=" + token, http.StatusBadRequest},
+		{"invalid token", "GET", "/?chatid=1234&dbtoken=" + url.QueryEscape(`"><script>alert(1)</script>`), http.StatusBadRequest},
+		{"unknown token", "GET", "/?chatid=1234&dbtoken=unknown", http.StatusNotFound},
+		{"other path", "GET", "/admin", http.StatusNotFound},
+		{"other method", "PUT", "/?chatid=1234&dbtoken=" + token, http.StatusMethodNotAllowed},
+		{"pass without request", "POST", "/?g-recaptcha-response=x&chatid=1234&dbtoken=" + token, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			homePage(recorder, httptest.NewRequest(test.method, test.target, nil))
+			if recorder.Code != test.status {
+				t.Fatalf("status = %d, want %d", recorder.Code, test.status)
+			}
+			if strings.Contains(recorder.Body.String(), "<script>alert") {
+				t.Error("the input is not escaped")
+			}
+			if test.status == http.StatusMethodNotAllowed || test.name == "other path" {
+				return
+			}
+			header := recorder.Header()
+			if !strings.HasPrefix(header.Get("Content-Type"), "text/html") || header.Get("X-Frame-Options") != "DENY" ||
+				!strings.Contains(header.Get("Content-Security-Policy"), "'nonce-") {
+				t.Errorf("missing security headers: %v", header)
+			}
+		})
+	}
+}
+
+func TestPageDataHidesUsers(t *testing.T) {
+	token := setupPages(t)
+	if err := loadCatalogs(defaultLocales); err != nil {
+		t.Fatal(err)
+	}
+	updateUser(1234, func(u *botUser) {
+		u.FirstName, u.UserName, u.Language = "Sam", "sam", "fa"
+	})
+	if data := newPageData(1234, token, ""); data.FirstName != "" || data.UserName != "" || data.Lang != "en" {
+		t.Errorf("the page of a user who has not asked for the token has %q, %q, %q", data.FirstName, data.UserName, data.Lang)
+	}
+	CaptchaToCheck.mux.Lock()
+	CaptchaToCheck.CaptchaToCheck[1234] = request{WantToken: "other"}
+	CaptchaToCheck.mux.Unlock()
+	defer safeReadCaptchaToCheckAndDelete(1234)
+	if data := newPageData(1234, token, ""); data.FirstName != "" {
+		t.Errorf("the page of a user who has asked for another token has %q", data.FirstName)
+	}
+	CaptchaToCheck.mux.Lock()
+	CaptchaToCheck.CaptchaToCheck[1234] = request{WantToken: token}
+	CaptchaToCheck.mux.Unlock()
+	if data := newPageData(1234, token, ""); data.FirstName != "Sam" || data.UserName != "sam" || data.Lang != "fa" {
+		t.Errorf("the page of a user who has asked for the token has %q, %q, %q", data.FirstName, data.UserName, data.Lang)
+	}
+}
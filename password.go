@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//How many wrong passwords a user can send before they have to solve the captcha again
+const maxPasswordAttempts = 3
+
+//How long a user has to send the password after passing the captcha
+const passwordTimeout = 10 * time.Minute
+
+//A user who passed the captcha of a token with a password and should send the password now
+type passwordRequest struct {
+	Token    string
+	Source   string
+	User     tgbotapi.User
+	Attempts int //Wrong passwords sent until now
+	Expires  time.Time
+}
+type sPasswordToCheck struct {
+	mux             sync.Mutex
+	PasswordToCheck map[int]passwordRequest
+}
+
+var PasswordToCheck = sPasswordToCheck{PasswordToCheck: make(map[int]passwordRequest)}
+
+//Hash a password with bcrypt; The salt is a part of the hash
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err == bcrypt.ErrPasswordTooLong {
+		return "", fmt.Errorf("the password is longer than 72 bytes")
+	} else if err != nil {
+		return "", fmt.Errorf("could not hash the password: %v", err)
+	}
+	return string(hash), nil
+}
+
+//Check the password of a token; Tokens without password accept everything
+func (meta tokenMeta) checkPassword(password string) bool {
+	if meta.PasswordHash == "" {
+		return true
+	}
+	return bcrypt.CompareHashAndPassword([]byte(meta.PasswordHash), []byte(password)) == nil
+}
+
+//The user passed the captcha; Ask for the password if the token has one, otherwise send the value
+func captchaPassed(chatID int64, user tgbotapi.User, token, source string) {
+	meta, err := store.ReadMeta(token)
+	if err != nil {
+		botSend(tgbotapi.NewMessage(chatID, tr(chatID, "database_error", err.Error())))
+		return
+	}
+	if meta.PasswordHash == "" {
+		revealOrAskApproval(chatID, user, token, source)
+		return
+	}
+	PasswordToCheck.mux.Lock()
+	for id, req := range PasswordToCheck.PasswordToCheck { //Forget the users who never sent the password
+		if time.Now().After(req.Expires) {
+			delete(PasswordToCheck.PasswordToCheck, id)
+		}
+	}
+	PasswordToCheck.PasswordToCheck[user.ID] = passwordRequest{Token: token, Source: source, User: user, Expires: time.Now().Add(passwordTimeout)}
+	PasswordToCheck.mux.Unlock()
+	botSend(tgbotapi.NewMessage(chatID, trToken(chatID, token, "password_ask")))
+}
+
+//Check the message of a user as the password if the user should send one
+//Returns false if the user is not asked for a password
+func processPassword(message *tgbotapi.Message) bool {
+	//The request is taken out while the password is checked; bcrypt is slow and should not block the other users
+	PasswordToCheck.mux.Lock()
+	req, exists := PasswordToCheck.PasswordToCheck[message.From.ID]
+	delete(PasswordToCheck.PasswordToCheck, message.From.ID)
+	PasswordToCheck.mux.Unlock()
+	if !exists {
+		return false
+	}
+	if time.Now().After(req.Expires) {
+		botSend(tgbotapi.NewMessage(message.Chat.ID, trToken(message.Chat.ID, req.Token, "password_expired")))
+		return true
+	}
+	meta, err := store.ReadMeta(req.Token)
+	if err == nil && meta.checkPassword(message.Text) {
+		revealOrAskApproval(message.Chat.ID, req.User, req.Token, req.Source)
+		return true
+	}
+	req.Attempts++
+	recordFailure(message.From.ID)
+	if req.Attempts < maxPasswordAttempts {
+		PasswordToCheck.mux.Lock()
+		if _, replaced := PasswordToCheck.PasswordToCheck[message.From.ID]; !replaced { //The user may have passed another captcha meanwhile
+			PasswordToCheck.PasswordToCheck[message.From.ID] = req
+		}
+		PasswordToCheck.mux.Unlock()
+	}
+	msg := tgbotapi.NewMessage(message.Chat.ID, "")
+	if err != nil {
+		msg.Text = tr(message.Chat.ID, "database_error", err.Error())
+	} else if req.Attempts >= maxPasswordAttempts {
+		log.Println("User", message.From.ID, "sent too many wrong passwords for", req.Token)
+		msg.Text = trToken(message.Chat.ID, req.Token, "password_no_attempts")
+	} else {
+		msg.Text = trToken(message.Chat.ID, req.Token, "password_wrong", maxPasswordAttempts-req.Attempts)
+	}
+	botSend(msg)
+	return true
+}
+
+//Forget the password request of a user
+func cancelPassword(id int) {
+	PasswordToCheck.mux.Lock()
+	delete(PasswordToCheck.PasswordToCheck, id)
+	PasswordToCheck.mux.Unlock()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const defaultPoolLowAlert = 10
+
+//Read the items of a pool from a message; Every non empty line is an item
+//Items can be sent as a text message or as a text file
+func readPoolItems(message *tgbotapi.Message) ([]string, error) {
+	text := message.Text
+	if message.Document != nil {
+		data, err := downloadFile(message.Document.FileID)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	var items []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			items = append(items, line)
+		}
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("there is no item in the message")
+	}
+	return items, nil
+}
+
+//Create a pool token or add items to an existing one if token is not empty
+func processPoolItems(message *tgbotapi.Message, token string) {
+	msg := tgbotapi.NewMessage(message.Chat.ID, "")
+	items, err := readPoolItems(message)
+	if err != nil {
+		msg.Text = "Error on reading the items: " + err.Error()
+		botSend(msg)
+		return
+	}
+	if token == "" {
+		token, err = store.InsertValue("Pool of unique items", tokenMeta{Pool: true})
+		if err != nil {
+			msg.Text = "Error in inserting the pool in database: " + err.Error()
+			botSend(msg)
+			return
+		}
+	}
+	if err = store.AddPoolItems(token, items); err != nil {
+		msg.Text = "Error in inserting the items in database: " + err.Error()
+		botSend(msg)
+		return
+	}
+	total, claimed, _ := store.PoolStatus(token)
+	msg.Text = fmt.Sprintf("Added %d items to `%s`. The pool has %d unused items now.\nEvery user who passes the captcha gets one of the items. Share this link with users:\n%s", len(items), token, total-claimed, escapeMarkdown(deepLink(token, "")))
+	msg.ParseMode = "markdown"
+	botSend(msg)
+}
+
+//Give an item of a pool to a user and alert the admins when the pool is running low
+//Users who get their item again do not change the pool so they do not alert
+func claimPoolItem(token string, user int) (string, error) {
+	item, remaining, claimed, err := store.ClaimPoolItem(token, user)
+	if err != nil && err != errPoolEmpty {
+		return "", err
+	}
+	alert := Config.PoolLowAlert
+	if alert == 0 {
+		alert = defaultPoolLowAlert
+	}
+	//The admins are alerted once when the last item is claimed, not for every user who finds the pool empty
+	if claimed && remaining == 0 {
+		notifyAdmins("The pool `" + token + "` is empty! The next users cannot get an item. Use `/pool " + token + "` to add more items.")
+	} else if claimed && remaining == alert {
+		notifyAdmins(fmt.Sprintf("The pool `%s` has %d unused items left. Use `/pool %s` to add more items.", token, remaining, token))
+	}
+	return item, err
+}
+
+//Send a markdown message to all of the admins
+func notifyAdmins(text string) {
+	for _, admin := range Config.Admins {
+		msg := tgbotapi.NewMessage(int64(admin), text)
+		msg.ParseMode = "markdown"
+		botSend(msg)
+	}
+	log.Println("Notified admins:", text)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg" //Logo can be jpeg as well
+	"image/png"
+	"os"
+
+	"github.com/skip2/go-qrcode"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const defaultQRSize = 512
+
+//Create a PNG QR code of the deep link of the token
+//If configured, the logo is drawn at the center of the code and the caption is written under it
+func TokenQRCode(token, source string) ([]byte, error) {
+	size := Config.QR.Size
+	if size <= 0 {
+		size = defaultQRSize
+	}
+	level := qrcode.Medium
+	var logo image.Image
+	if Config.QR.Logo != "" {
+		f, err := os.Open(Config.QR.Logo)
+		if err != nil {
+			return nil, fmt.Errorf("could not open the logo: %v", err)
+		}
+		logo, _, err = image.Decode(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not decode the logo: %v", err)
+		}
+		level = qrcode.Highest //The logo covers some of the code
+	}
+	qr, err := qrcode.New(deepLink(token, source), level)
+	if err != nil {
+		return nil, fmt.Errorf("could not create the qr code: %v", err)
+	}
+	height := size
+	if Config.QR.Caption != "" {
+		height += size / 8
+	}
+	img := image.NewRGBA(image.Rect(0, 0, size, height))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, size, size), qr.Image(size), image.Point{}, draw.Src)
+	if logo != nil {
+		drawLogo(img, logo, size)
+	}
+	if Config.QR.Caption != "" {
+		drawCaption(img, Config.QR.Caption, image.Rect(0, size, size, height))
+	}
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("could not encode the qr code: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+//Draw the logo in the center of a QR code with the size of size; The logo takes at most a fifth of the code
+func drawLogo(img draw.Image, logo image.Image, size int) {
+	box := size / 5
+	w, h := logo.Bounds().Dx(), logo.Bounds().Dy()
+	if w >= h {
+		w, h = box, h*box/w
+	} else {
+		w, h = w*box/h, box
+	}
+	center := image.Pt(size/2, size/2)
+	//Keep a white margin around the logo so the logo is separated from the code
+	margin := image.Rect(center.X-w/2, center.Y-h/2, center.X+w/2, center.Y+h/2).Inset(-size / 100)
+	draw.Draw(img, margin, image.White, image.Point{}, draw.Src)
+	scaled := scaleImage(logo, w, h)
+	draw.Draw(img, scaled.Bounds().Add(center.Sub(image.Pt(w/2, h/2))), scaled, image.Point{}, draw.Over)
+}
+
+//Write the text in the center of the area with the biggest size that fits
+func drawCaption(img draw.Image, text string, area image.Rectangle) {
+	face := basicfont.Face7x13
+	width := font.MeasureString(face, text).Ceil()
+	if width == 0 {
+		return
+	}
+	small := image.NewRGBA(image.Rect(0, 0, width, face.Height))
+	d := font.Drawer{
+		Dst:  small,
+		Src:  image.NewUniform(color.Black),
+		Face: face,
+		Dot:  fixed.P(0, face.Ascent),
+	}
+	d.DrawString(text)
+	//Basic font is tiny; Scale it to fill the area
+	scale := float64(area.Dx()) * 0.9 / float64(width)
+	if s := float64(area.Dy()) * 0.8 / float64(face.Height); s < scale {
+		scale = s
+	}
+	w, h := int(float64(width)*scale), int(float64(face.Height)*scale)
+	if w == 0 || h == 0 {
+		return
+	}
+	scaled := scaleImage(small, w, h)
+	offset := image.Pt(area.Min.X+(area.Dx()-w)/2, area.Min.Y+(area.Dy()-h)/2)
+	draw.Draw(img, scaled.Bounds().Add(offset), scaled, image.Point{}, draw.Over)
+}
+
+//Resize an image with nearest neighbor
+func scaleImage(src image.Image, w, h int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	b := src.Bounds()
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dst.Set(x, y, src.At(b.Min.X+x*b.Dx()/w, b.Min.Y+y*b.Dy()/h))
+		}
+	}
+	return dst
+}
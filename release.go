@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+//Kind of the records of the users who want to be notified when a token is released; Their keys are token:userID
+const subscriptionRecords = "subscription"
+
+//A user who pressed "Notify me" on a token which is not released yet
+type subscription struct {
+	Token  string
+	User   tgbotapi.User
+	ChatID int64
+}
+
+//The data of jobRelease
+type releaseJob struct {
+	Token string
+	At    time.Time //The release time of the token when the job was scheduled; If it has changed the job is ignored
+}
+
+//Schedule notifying the subscribers of a token at its release time
+//If the release time is removed or moved to the past, the subscribers are notified right away
+func scheduleRelease(token string, meta tokenMeta) {
+	at := meta.NotBefore
+	if !time.Now().Before(at) {
+		if !hasSubscribers(token) {
+			return
+		}
+		at = time.Now()
+	}
+	if err := scheduleJob(at, jobRelease, releaseJob{Token: token, At: meta.NotBefore}); err != nil {
+		log.Println("Cannot schedule the release of", token, ":", err.Error())
+	}
+}
+
+//Check if anyone is waiting for the release of a token
+func hasSubscribers(token string) bool {
+	found := false
+	err := store.ForEachRecord(subscriptionRecords, func(key string, _ []byte) error {
+		if strings.HasPrefix(key, token+":") {
+			found = true
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Cannot read the subscriptions:", err.Error())
+	}
+	return found
+}
+
+//Tell the user when the token is released and let them subscribe to it
+func sendCountdown(chatID int64, token string, release time.Time) {
+	left := time.Until(release)
+	if left > time.Minute {
+		left = left.Round(time.Minute)
+	} else {
+		left = left.Round(time.Second)
+	}
+	msg := tgbotapi.NewMessage(chatID, trToken(chatID, token, "countdown", left, release.Format("2006-01-02 15:04 MST")))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(trToken(chatID, token, "notify_button"), "notify:"+token)))
+	botSend(msg)
+}
+
+//Save the user to notify them when the token is released
+func subscribeRelease(query *tgbotapi.CallbackQuery, token string) {
+	userChat := int64(query.From.ID)
+	answer := trToken(userChat, token, "notify_saved")
+	if meta, err := store.ReadMeta(token); err != nil || !store.HasKey(token) {
+		answer = trToken(userChat, token, "notify_gone")
+	} else if !time.Now().Before(meta.NotBefore) {
+		answer = trToken(userChat, token, "notify_available")
+	} else if query.Message == nil {
+		answer = trToken(userChat, token, "notify_resend")
+	} else {
+		s := subscription{Token: token, User: *query.From, ChatID: query.Message.Chat.ID}
+		if err = putJSONRecord(subscriptionRecords, token+":"+strconv.Itoa(query.From.ID), s); err != nil {
+			log.Println("Cannot save the subscription:", err.Error())
+			answer = trToken(userChat, token, "save_error", err.Error())
+		}
+	}
+	_, _ = bot.AnswerCallbackQuery(tgbotapi.NewCallbackWithAlert(query.ID, answer))
+}
+
+//Notify the subscribers of a released token and start the captcha for them
+func runRelease(data json.RawMessage) error {
+	var job releaseJob
+	if err := json.Unmarshal(data, &job); err != nil {
+		return err
+	}
+	if !store.HasKey(job.Token) { //The token is removed
+		return nil
+	}
+	meta, err := store.ReadMeta(job.Token)
+	if err != nil {
+		return err
+	}
+	if !meta.NotBefore.Equal(job.At) { //The release time is changed; Another job is scheduled for it
+		return nil
+	}
+	var keys []string
+	var subscribers []subscription
+	err = store.ForEachRecord(subscriptionRecords, func(key string, value []byte) error {
+		if !strings.HasPrefix(key, job.Token+":") {
+			return nil
+		}
+		var s subscription
+		if err := json.Unmarshal(value, &s); err != nil {
+			log.Println("Removing corrupted subscription:", err.Error())
+		} else {
+			subscribers = append(subscribers, s)
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err = store.DeleteRecord(subscriptionRecords, key); err != nil {
+			return err
+		}
+	}
+	log.Println("Released", job.Token, "and notifying", len(subscribers), "users")
+	for _, s := range subscribers {
+		botSend(tgbotapi.NewMessage(s.ChatID, trToken(s.ChatID, s.Token, "released", s.Token)))
+		processToken(s.Token, "", s.User, s.ChatID)
+	}
+	return nil
+}
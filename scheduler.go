@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+//How often the scheduler checks for the due jobs
+const schedulerInterval = time.Second
+
+//Kinds of the jobs
+const (
+	jobDeleteMessage = "delete"
+	jobRelease       = "release"
+)
+
+//A job which is saved in the store to run later, even after a restart
+type scheduledJob struct {
+	At   time.Time
+	Kind string
+	Data json.RawMessage //Depends on the kind
+}
+
+//The data of jobDeleteMessage
+type deleteMessageJob struct {
+	ChatID    int64
+	MessageID int
+}
+
+//The functions which run each kind of job
+var jobHandlers = map[string]func(data json.RawMessage) error{
+	jobDeleteMessage: runDeleteMessage,
+	jobRelease:       runRelease,
+}
+
+//Save a job in the store; data is encoded as JSON
+func scheduleJob(at time.Time, kind string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("could not encode the job: %v", err)
+	}
+	return store.AddJob(scheduledJob{At: at, Kind: kind, Data: b})
+}
+
+//Run the due jobs forever. Jobs which were due while the bot was down run on the first check
+func schedulerLoop() {
+	for {
+		jobs, err := store.DueJobs(time.Now())
+		if err != nil {
+			log.Println("Cannot read the scheduled jobs:", err.Error())
+		}
+		for _, job := range jobs {
+			handler, exists := jobHandlers[job.Kind]
+			if !exists {
+				log.Println("Unknown job kind:", job.Kind)
+				continue
+			}
+			if err = handler(job.Data); err != nil {
+				log.Println("Error on running", job.Kind, "job:", err.Error())
+			}
+		}
+		time.Sleep(schedulerInterval)
+	}
+}
+
+func runDeleteMessage(data json.RawMessage) error {
+	var job deleteMessageJob
+	if err := json.Unmarshal(data, &job); err != nil {
+		return err
+	}
+	_, err := queueRequest(job.ChatID, func() (tgbotapi.Message, error) {
+		_, err := bot.DeleteMessage(tgbotapi.NewDeleteMessage(job.ChatID, job.MessageID))
+		return tgbotapi.Message{}, err
+	}, true)
+	return err
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+//Defaults of the send queue; See sendConfig
+const (
+	defaultSendRate      = 30
+	defaultChatInterval  = time.Second
+	defaultGroupInterval = 3 * time.Second
+	defaultSendRetries   = 5
+	maxSendBackoff       = 30 * time.Second
+)
+
+//A request which is waiting in the send queue
+type outgoing struct {
+	chatID int64
+	do     func() (tgbotapi.Message, error)
+	result chan sendResult //Nil if nobody waits for the result
+}
+
+type sendResult struct {
+	message tgbotapi.Message
+	err     error
+}
+
+//Every request to Telegram which sends something goes through this queue.
+//Each chat has its own queue so the messages of a chat are sent in order, and a slow chat does not stop the others.
+//All of the chats share the global rate limit.
+var sendQueue = struct {
+	mux         sync.Mutex
+	chats       map[int64][]*outgoing //The chats which have a worker and their waiting requests
+	pausedUntil time.Time             //Telegram asked to stop sending until this time
+	global      <-chan time.Time
+	once        sync.Once
+}{chats: make(map[int64][]*outgoing)}
+
+//Queue a message; Errors are logged
+func botSend(message tgbotapi.Chattable) {
+	queueRequest(chatOf(message), func() (tgbotapi.Message, error) {
+		return bot.Send(message)
+	}, false)
+}
+
+//Queue a message and wait until it is sent
+func botSendWait(message tgbotapi.Chattable) (tgbotapi.Message, error) {
+	return queueRequest(chatOf(message), func() (tgbotapi.Message, error) {
+		return bot.Send(message)
+	}, true)
+}
+
+//Queue a request which the library does not support and wait for the message which it returns
+func botRequestWait(chatID int64, endpoint string, params url.Values) (tgbotapi.Message, error) {
+	return queueRequest(chatID, func() (tgbotapi.Message, error) {
+		var message tgbotapi.Message
+		resp, err := bot.MakeRequest(endpoint, params)
+		if err == nil && len(resp.Result) > 0 && resp.Result[0] == '{' {
+			err = json.Unmarshal(resp.Result, &message)
+		}
+		return message, err
+	}, true)
+}
+
+//Add a request to the queue of its chat and start a worker for the chat if it has none
+func queueRequest(chatID int64, do func() (tgbotapi.Message, error), wait bool) (tgbotapi.Message, error) {
+	sendQueue.once.Do(func() {
+		rate := Config.Send.Rate
+		if rate <= 0 {
+			rate = defaultSendRate
+		}
+		sendQueue.global = time.NewTicker(time.Second / time.Duration(rate)).C
+	})
+	req := &outgoing{chatID: chatID, do: do}
+	if wait {
+		req.result = make(chan sendResult, 1)
+	}
+	sendQueue.mux.Lock()
+	waiting, hasWorker := sendQueue.chats[chatID]
+	sendQueue.chats[chatID] = append(waiting, req)
+	sendQueue.mux.Unlock()
+	if !hasWorker {
+		go chatWorker(chatID)
+	}
+	if !wait {
+		return tgbotapi.Message{}, nil
+	}
+	result := <-req.result
+	return result.message, result.err
+}
+
+//Send the requests of a chat one by one; The worker stops when the queue of the chat is empty
+func chatWorker(chatID int64) {
+	interval := time.Duration(Config.Send.ChatInterval) * time.Millisecond
+	if interval <= 0 {
+		interval = defaultChatInterval
+	}
+	if chatID < 0 { //Groups and channels
+		interval = time.Duration(Config.Send.GroupInterval) * time.Millisecond
+		if interval <= 0 {
+			interval = defaultGroupInterval
+		}
+	}
+	var last time.Time
+	for {
+		sendQueue.mux.Lock()
+		waiting := sendQueue.chats[chatID]
+		if len(waiting) == 0 {
+			delete(sendQueue.chats, chatID)
+			sendQueue.mux.Unlock()
+			return
+		}
+		req := waiting[0]
+		sendQueue.chats[chatID] = waiting[1:]
+		sendQueue.mux.Unlock()
+
+		if chatID != 0 {
+			time.Sleep(time.Until(last.Add(interval)))
+		}
+		message, err := sendWithRetry(req)
+		last = time.Now()
+		if err != nil {
+			log.Println("Error on sending a message to", chatID, ":", err.Error())
+			if isBlockedError(err) && chatID > 0 {
+				markBlocked(chatID)
+			}
+		}
+		if req.result != nil {
+			req.result <- sendResult{message, err}
+		}
+	}
+}
+
+//Send a request respecting the global rate; Flood limits are waited and network errors are retried with backoff
+func sendWithRetry(req *outgoing) (tgbotapi.Message, error) {
+	retries := Config.Send.Retries
+	if retries <= 0 {
+		retries = defaultSendRetries
+	}
+	backoff := time.Second
+	for try := 0; ; try++ {
+		sendQueue.mux.Lock()
+		paused := time.Until(sendQueue.pausedUntil)
+		sendQueue.mux.Unlock()
+		time.Sleep(paused)
+		<-sendQueue.global
+
+		message, err := req.do()
+		if err == nil {
+			return message, nil
+		}
+		description, refused := telegramError(err)
+		retryAfter := floodWait(err, description)
+		switch {
+		case retryAfter > 0: //Too many requests
+			log.Println("Flood limit reached; Waiting", retryAfter)
+			sendQueue.mux.Lock()
+			if until := time.Now().Add(retryAfter); until.After(sendQueue.pausedUntil) {
+				sendQueue.pausedUntil = until
+			}
+			sendQueue.mux.Unlock()
+		case refused: //Telegram refused the request; Trying again does not help
+			return message, err
+		case try >= retries:
+			return message, err
+		default: //Network errors
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxSendBackoff {
+				backoff = maxSendBackoff
+			}
+		}
+	}
+}
+
+//Telegram starts the description of the errors of the requests with their status
+var refusedPrefixes = []string{"Bad Request", "Unauthorized", "Forbidden", "Not Found", "Conflict", "Too Many Requests"}
+
+//Get the description of an error which Telegram answered; Uploads return it as a plain error instead of tgbotapi.Error
+//The second value is false for network errors and invalid responses which can be retried
+func telegramError(err error) (string, bool) {
+	if apiErr, ok := err.(tgbotapi.Error); ok {
+		return apiErr.Message, true
+	}
+	if _, isNetworkError := err.(net.Error); err == nil || isNetworkError {
+		return "", false
+	}
+	for _, prefix := range refusedPrefixes {
+		if strings.HasPrefix(err.Error(), prefix) {
+			return err.Error(), true
+		}
+	}
+	return "", false
+}
+
+//How long Telegram asked to wait before sending again; Zero if it is not a flood limit
+func floodWait(err error, description string) time.Duration {
+	if apiErr, ok := err.(tgbotapi.Error); ok && apiErr.RetryAfter > 0 {
+		return time.Duration(apiErr.RetryAfter) * time.Second
+	}
+	var seconds int
+	if i := strings.Index(description, "retry after "); i >= 0 { //Like "Too Many Requests: retry after 5"
+		fmt.Sscanf(description[i+len("retry after "):], "%d", &seconds)
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+//The chat of a request for the per chat rate limit; Zero if it is unknown
+func chatOf(message tgbotapi.Chattable) int64 {
+	switch m := message.(type) {
+	case tgbotapi.MessageConfig:
+		return m.ChatID
+	case tgbotapi.DocumentConfig:
+		return m.ChatID
+	case tgbotapi.PhotoConfig:
+		return m.ChatID
+	case tgbotapi.EditMessageTextConfig:
+		return m.ChatID
+	case tgbotapi.EditMessageReplyMarkupConfig:
+		return m.ChatID
+	case tgbotapi.DeleteMessageConfig:
+		return m.ChatID
+	}
+	return 0
+}
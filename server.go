@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//How often the certificate files are checked for a renewed certificate
+const certReloadInterval = time.Minute
+
+//Keeps the certificate of the web server and loads it again when its files change
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mux      sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time //The latest modification time of the files when they were loaded
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+//Load the certificate if the files have changed since the last load; Returns true if it was loaded
+func (r *certReloader) reload() (bool, error) {
+	var modTime time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, fmt.Errorf("could not read %s: %v", file, err)
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	r.mux.RLock()
+	changed := r.cert == nil || modTime.After(r.modTime)
+	r.mux.RUnlock()
+	if !changed {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil { //Certbot may be writing the files; The old certificate is used until they are valid
+		return false, fmt.Errorf("could not load the certificate: %v", err)
+	}
+	r.mux.Lock()
+	r.cert, r.modTime = &cert, modTime
+	r.mux.Unlock()
+	return true, nil
+}
+
+//Check the files forever
+func (r *certReloader) watch() {
+	for range time.Tick(certReloadInterval) {
+		if loaded, err := r.reload(); err != nil {
+			log.Println("Cannot reload the certificate:", err.Error())
+		} else if loaded {
+			log.Println("Reloaded the certificate from", r.certFile)
+		}
+	}
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	return r.cert, nil
+}
+
+//The web server uses HTTPS if it has a certificate
+func useTLS() bool {
+	return Config.Recaptcha.CertFile != ""
+}
+
+//The host of the links of the web server; The port is omitted if it is the default port of the scheme
+func publicHost(scheme string) string {
+	port := Config.Recaptcha.PublicPort
+	if port == 0 {
+		port = Config.Recaptcha.Port
+	}
+	if scheme == "http" && port == 80 || scheme == "https" && port == 443 {
+		return Config.Recaptcha.Domain
+	}
+	return Config.Recaptcha.Domain + ":" + strconv.Itoa(port)
+}
+
+//The link of the verification page of a user
+func pageURL(chatID int64, token, source string) string {
+	u := url.URL{Scheme: "http", Path: "/"}
+	if useTLS() {
+		u.Scheme = "https"
+	}
+	u.Host = publicHost(u.Scheme)
+	u.RawQuery = url.Values{"chatid": {strconv.FormatInt(chatID, 10)}, "dbtoken": {token}, "source": {source}}.Encode()
+	return u.String()
+}
+
+//Start the verification page; With a certificate it is served over HTTPS and RedirectPort redirects the HTTP requests to it
+func startWebServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", homePage)
+	server := &http.Server{
+		Addr:              ":" + strconv.Itoa(Config.Recaptcha.Port),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+	if !useTLS() {
+		log.Println("Starting the web server on port", Config.Recaptcha.Port)
+		log.Fatal("failed to start server ", server.ListenAndServe())
+	}
+	certs, err := newCertReloader(Config.Recaptcha.CertFile, Config.Recaptcha.KeyFile)
+	if err != nil {
+		log.Fatal("failed to start server ", err)
+	}
+	go certs.watch()
+	server.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12}
+	if Config.Recaptcha.RedirectPort != 0 {
+		go redirectToHTTPS()
+	}
+	log.Println("Starting the web server with TLS on port", Config.Recaptcha.Port)
+	log.Fatal("failed to start server ", server.ListenAndServeTLS("", ""))
+}
+
+//Send the plain HTTP requests to the HTTPS server; The domain of the config is used instead of the Host header
+func redirectToHTTPS() {
+	server := &http.Server{
+		Addr: ":" + strconv.Itoa(Config.Recaptcha.RedirectPort),
+		Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			u := url.URL{Scheme: "https", Host: publicHost("https"), Path: request.URL.Path, RawQuery: request.URL.RawQuery}
+			http.Redirect(writer, request, u.String(), http.StatusMovedPermanently)
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       time.Minute,
+	}
+	log.Println("Redirecting HTTP on port", Config.Recaptcha.RedirectPort, "to HTTPS")
+	log.Fatal("failed to start the redirect server ", server.ListenAndServe())
+}
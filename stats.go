@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+//Every token has a bucket under the stats bucket with these keys:
+// total : The tokenStats of all times
+// daily : A bucket of days (in dayFormat) to the tokenStats of that day
+// users : A bucket of user IDs who requested the token to the first time they did
+// sources : A bucket of deep link sources to the tokenStats of that source; Users without source are counted as directSource
+const statsBucket = "Stats"
+const dayFormat = "2006-01-02"
+const directSource = "direct"
+
+type statEvent byte
+
+const (
+	statRequest statEvent = iota //User sent the token
+	statPass                     //User solved the captcha
+	statFail                     //User failed the captcha
+)
+
+type tokenStats struct {
+	Requests uint64
+	Pass     uint64
+	Fail     uint64
+}
+
+//Increase the counter of event
+func (stats *tokenStats) add(event statEvent) {
+	switch event {
+	case statRequest:
+		stats.Requests++
+	case statPass:
+		stats.Pass++
+	case statFail:
+		stats.Fail++
+	}
+}
+
+//Everything we know about a token
+type tokenReport struct {
+	Token       string
+	Total       tokenStats
+	Daily       map[string]tokenStats
+	Sources     map[string]tokenStats
+	UniqueUsers int
+}
+
+//Record an event for a token coming from source; Events of tokens which do not exist are ignored
+func (s *boltStore) RecordStat(token, source string, user int, event statEvent) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("DB")).Get([]byte(token)) == nil {
+			return nil
+		}
+		root, err := tx.Bucket([]byte(statsBucket)).CreateBucketIfNotExists([]byte(token))
+		if err != nil {
+			return fmt.Errorf("could not create stats bucket: %v", err)
+		}
+		if err = addStat(root, []byte("total"), event); err != nil {
+			return err
+		}
+		daily, err := root.CreateBucketIfNotExists([]byte("daily"))
+		if err != nil {
+			return fmt.Errorf("could not create daily bucket: %v", err)
+		}
+		if err = addStat(daily, []byte(time.Now().Format(dayFormat)), event); err != nil {
+			return err
+		}
+		sources, err := root.CreateBucketIfNotExists([]byte("sources"))
+		if err != nil {
+			return fmt.Errorf("could not create sources bucket: %v", err)
+		}
+		if source == "" {
+			source = directSource
+		}
+		if err = addStat(sources, []byte(source), event); err != nil {
+			return err
+		}
+		if event != statRequest {
+			return nil
+		}
+		users, err := root.CreateBucketIfNotExists([]byte("users"))
+		if err != nil {
+			return fmt.Errorf("could not create users bucket: %v", err)
+		}
+		key := []byte(strconv.Itoa(user))
+		if users.Get(key) == nil {
+			return users.Put(key, []byte(time.Now().Format(time.RFC3339)))
+		}
+		return nil
+	})
+}
+
+//Increase the counter of event in the tokenStats saved in key
+func addStat(bucket *bolt.Bucket, key []byte, event statEvent) error {
+	var stats tokenStats
+	if v := bucket.Get(key); v != nil {
+		if err := json.Unmarshal(v, &stats); err != nil {
+			return fmt.Errorf("corrupted stats: %v", err)
+		}
+	}
+	stats.add(event)
+	v, _ := json.Marshal(stats)
+	return bucket.Put(key, v)
+}
+
+//Read the stats of one token; If there is no stats for it, an empty report is returned
+//Users is filled with the ID of the users who requested the token
+func readStats(root *bolt.Bucket, token string, users map[string]struct{}) (tokenReport, error) {
+	report := tokenReport{Token: token, Daily: make(map[string]tokenStats), Sources: make(map[string]tokenStats)}
+	if root == nil {
+		return report, nil
+	}
+	if v := root.Get([]byte("total")); v != nil {
+		if err := json.Unmarshal(v, &report.Total); err != nil {
+			return report, fmt.Errorf("corrupted stats: %v", err)
+		}
+	}
+	if err := readStatsBucket(root.Bucket([]byte("daily")), report.Daily); err != nil {
+		return report, err
+	}
+	if err := readStatsBucket(root.Bucket([]byte("sources")), report.Sources); err != nil {
+		return report, err
+	}
+	if userBucket := root.Bucket([]byte("users")); userBucket != nil {
+		_ = userBucket.ForEach(func(k, _ []byte) error {
+			report.UniqueUsers++
+			if users != nil {
+				users[string(k)] = struct{}{}
+			}
+			return nil
+		})
+	}
+	return report, nil
+}
+
+//Read all of tokenStats in a bucket into m
+func readStatsBucket(bucket *bolt.Bucket, m map[string]tokenStats) error {
+	if bucket == nil {
+		return nil
+	}
+	return bucket.ForEach(func(k, v []byte) error {
+		var stats tokenStats
+		if err := json.Unmarshal(v, &stats); err != nil {
+			return fmt.Errorf("corrupted stats: %v", err)
+		}
+		m[string(k)] = stats
+		return nil
+	})
+}
+
+//Get the stats of a token
+func (s *boltStore) ReadStats(token string) (tokenReport, error) {
+	var report tokenReport
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		report, err = readStats(tx.Bucket([]byte(statsBucket)).Bucket([]byte(token)), token, nil)
+		return err
+	})
+	return report, err
+}
+
+//Get the stats of all tokens, sorted by the number of requests
+//The second value is the number of distinct users among all tokens
+func (s *boltStore) ReadAllStats() ([]tokenReport, int, error) {
+	var reports []tokenReport
+	users := make(map[string]struct{})
+	err := s.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(statsBucket))
+		return root.ForEach(func(k, v []byte) error {
+			if v != nil { //Only buckets
+				return nil
+			}
+			report, err := readStats(root.Bucket(k), string(k), users)
+			if err != nil {
+				return err
+			}
+			reports = append(reports, report)
+			return nil
+		})
+	})
+	sortReports(reports)
+	return reports, len(users), err
+}
+
+//Sort the reports by the number of requests
+func sortReports(reports []tokenReport) {
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Total.Requests > reports[j].Total.Requests
+	})
+}
+
+//Remove all stats of a token
+func removeStats(tx *bolt.Tx, token string) error {
+	err := tx.Bucket([]byte(statsBucket)).DeleteBucket([]byte(token))
+	if err != nil && err != bolt.ErrBucketNotFound {
+		return fmt.Errorf("could not delete stats: %v", err)
+	}
+	return nil
+}
+
+//Percent of passed captchas
+func (s tokenStats) passRate() float64 {
+	if s.Pass+s.Fail == 0 {
+		return 0
+	}
+	return float64(s.Pass) * 100 / float64(s.Pass+s.Fail)
+}
+
+func (s tokenStats) String() string {
+	return fmt.Sprintf("%d requests, %d passed, %d failed (%.1f%% pass rate)", s.Requests, s.Pass, s.Fail, s.passRate())
+}
+
+//Build the text of /stats command; If token is empty, the overall stats are returned
+func statsText(token string) (string, error) {
+	var sb strings.Builder
+	if token != "" {
+		report, err := store.ReadStats(token)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString("Stats of `" + token + "`\n")
+		sb.WriteString("Total: " + report.Total.String() + "\n")
+		sb.WriteString("Unique users: " + strconv.Itoa(report.UniqueUsers) + "\n")
+		if meta, err := store.ReadMeta(token); err == nil && meta.Pool {
+			total, claimed, err := store.PoolStatus(token)
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString(fmt.Sprintf("Pool: %d of %d items are given away\n", claimed, total))
+		}
+		sb.WriteString("\nLast 7 days:\n")
+		for i := 6; i >= 0; i-- {
+			day := time.Now().AddDate(0, 0, -i).Format(dayFormat)
+			sb.WriteString(day + ": " + report.Daily[day].String() + "\n")
+		}
+		//Sort the sources by the reveals they brought
+		sources := make([]string, 0, len(report.Sources))
+		for source := range report.Sources {
+			sources = append(sources, source)
+		}
+		sort.Slice(sources, func(i, j int) bool {
+			return report.Sources[sources[i]].Pass > report.Sources[sources[j]].Pass
+		})
+		if len(sources) > 0 {
+			sb.WriteString("\nSources:\n")
+		}
+		for _, source := range sources {
+			sb.WriteString(escapeMarkdown(source) + ": " + report.Sources[source].String() + "\n")
+		}
+		return sb.String(), nil
+	}
+	reports, users, err := store.ReadAllStats()
+	if err != nil {
+		return "", err
+	}
+	var total tokenStats
+	for _, report := range reports {
+		total.Requests += report.Total.Requests
+		total.Pass += report.Total.Pass
+		total.Fail += report.Total.Fail
+	}
+	sb.WriteString("Total: " + total.String() + "\n")
+	sb.WriteString("Unique users: " + strconv.Itoa(users) + "\n\nTop tokens:\n")
+	for i := 0; i < len(reports) && i < 10; i++ {
+		sb.WriteString("`" + reports[i].Token + "` : " + reports[i].Total.String() + ", " + strconv.Itoa(reports[i].UniqueUsers) + " users\n")
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"time"
+)
+
+const alphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+var errTokenExpired = errors.New("this token has expired")
+var errTokenUsedUp = errors.New("this token has reached its usage limit")
+var errNotSupported = errors.New("this storage does not support this operation")
+var errPoolEmpty = errors.New("all of the items of this token are given away")
+var errNotReleased = errors.New("this token is not available yet")
+var errRecordNotFound = errors.New("record not found")
+var errRecordExists = errors.New("record exists")
+
+//Store is where the bot keeps the tokens, their metadata and their stats
+type Store interface {
+	//Inserts a value into the database and returns the token for it
+	InsertValue(value string, meta tokenMeta) (string, error)
+	//Insert a lot of values at once; Errors of each value are in its result and do not stop the others
+	InsertValues(values []bulkValue) ([]bulkResult, error)
+	//Check if a token exists; On errors return false as well
+	HasKey(key string) bool
+	//Remove a token with its metadata and stats
+	RemoveKey(key string) error
+	//All of the tokens and their values
+	ListAllValues() (map[string]string, error)
+	//All of the tokens sorted
+	ListKeys() ([]string, error)
+	ReadValue(key string) (string, error)
+	//Replace the value of an existing token
+	UpdateValue(key, value string) error
+	//Read the value to give it to a user; The usage limit and the expiry are checked and the usage is counted
+	RevealValue(key string) (string, error)
+	//Tokens without metadata have an empty one
+	ReadMeta(key string) (tokenMeta, error)
+	//Change the metadata of an existing token atomically
+	UpdateMeta(key string, update func(meta *tokenMeta) error) error
+	//Add items to the pool of a token
+	AddPoolItems(token string, items []string) error
+	//Give the next unused item of the pool of a token to the user; The same user always gets the same item
+	//Remaining is the number of the items which are not claimed yet; Claimed is false if the user already had the item
+	ClaimPoolItem(token string, user int) (item string, remaining int, claimed bool, err error)
+	PoolStatus(token string) (total, claimed int, err error)
+	//Replace every item of the pool of a token with what rewrite returns; Returns the number of the changed items
+	RewritePoolItems(token string, rewrite func(item string) (string, error)) (int, error)
+	//Save a job to run later
+	AddJob(job scheduledJob) error
+	//Remove the jobs which should run until now and return them
+	DueJobs(now time.Time) ([]scheduledJob, error)
+	//Records are small documents of the features of the bot like the pending approvals; They are grouped by kind
+	PutRecord(kind, key string, value []byte) error
+	//Returns errRecordNotFound if the record does not exist
+	GetRecord(kind, key string) ([]byte, error)
+	//Change a record atomically; update gets nil if the record does not exist and returns the new value
+	//Nothing is saved if update returns an error and the error is returned
+	UpdateRecord(kind, key string, update func(value []byte) ([]byte, error)) error
+	//Read and delete a record at once so only one caller can get it; Returns errRecordNotFound if the record does not exist
+	TakeRecord(kind, key string) ([]byte, error)
+	DeleteRecord(kind, key string) error
+	//Call f for every record of a kind; The value must not be used after f returns
+	ForEachRecord(kind string, f func(key string, value []byte) error) error
+	//Record an event for a token coming from source; Events of tokens which do not exist are ignored
+	RecordStat(token, source string, user int, event statEvent) error
+	//If there is no stats for the token, an empty report is returned
+	ReadStats(token string) (tokenReport, error)
+	//Stats of all tokens sorted by the number of requests and the number of distinct users among them
+	ReadAllStats() ([]tokenReport, int, error)
+	Close() error
+}
+
+//Stores which can be dumped with /export and restored with /import
+type dumpStore interface {
+	Export(w io.Writer) error
+	Import(r io.Reader, overwrite bool) error
+}
+
+//Stores which are files and can be maintained from command line or backed up while running
+type fileStore interface {
+	//Write a consistent copy of the database to a new file
+	Snapshot(name string) error
+	//Rewrite the database to reclaim the free space
+	Compact() error
+	//Return the problems in the database
+	Verify() ([]string, error)
+	//Human readable information about the database
+	Info() (string, error)
+}
+
+type tokenMeta struct {
+	Created time.Time
+	Expire  time.Time //Zero means never
+	MaxUses int       //Number of times that the value can be revealed; 0 means unlimited
+	Uses    int
+	Pool    bool //Users get an item of the pool of the token instead of the value
+	//Sent values are deleted from the chat after this many seconds; 0 means never
+	DeleteAfter  int
+	Protect      bool      //Users cannot forward or save the sent value
+	PasswordHash string    //The bcrypt hash of the password which users must send after the captcha; Empty means no password
+	Approval     bool      //An admin must approve every user before the value is sent
+	NotBefore    time.Time //The token cannot be revealed before this time; Zero means no limit
+}
+
+//Check if the token can be revealed now
+func (meta tokenMeta) check() error {
+	if time.Now().Before(meta.NotBefore) {
+		return errNotReleased
+	}
+	if !meta.Expire.IsZero() && time.Now().After(meta.Expire) {
+		return errTokenExpired
+	}
+	if meta.MaxUses > 0 && meta.Uses >= meta.MaxUses {
+		return errTokenUsedUp
+	}
+	return nil
+}
+
+//A value to insert in InsertValues
+type bulkValue struct {
+	Key   string //Optional
+	Value string
+	Meta  tokenMeta
+}
+
+//Open the storage of the config
+func OpenStore(kind, name string) (Store, error) {
+	switch kind {
+	case "", "bolt":
+		return openBoltStore(name)
+	case "sqlite":
+		return openSQLStore(name)
+	case "memory":
+		return newMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown storage %s; It must be bolt, sqlite or memory", kind)
+}
+
+//Keys are 8 letter long
+func generateRandomString() string {
+	s := ""
+	for i := 0; i < 8; i++ {
+		s += string(alphabet[rand.Int31n(52)])
+	}
+	return s
+}
+
+//Save a record as JSON
+func putJSONRecord(kind, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("could not encode the record: %v", err)
+	}
+	return store.PutRecord(kind, key, b)
+}
+
+//Save a record as JSON only if it does not exist, so only one caller can create it; Returns false if it exists
+func addJSONRecord(kind, key string, v interface{}) (bool, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return false, fmt.Errorf("could not encode the record: %v", err)
+	}
+	err = store.UpdateRecord(kind, key, func(value []byte) ([]byte, error) {
+		if value != nil {
+			return nil, errRecordExists
+		}
+		return b, nil
+	})
+	if err == errRecordExists {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+//Replace a record with v as JSON only if it exists; Returns errRecordNotFound if it does not
+func replaceJSONRecord(kind, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("could not encode the record: %v", err)
+	}
+	return store.UpdateRecord(kind, key, func(value []byte) ([]byte, error) {
+		if value == nil {
+			return nil, errRecordNotFound
+		}
+		return b, nil
+	})
+}
+
+//Read a JSON record in v
+func getJSONRecord(kind, key string, v interface{}) error {
+	b, err := store.GetRecord(kind, key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+//Read a JSON record in v and delete it
+func takeJSONRecord(kind, key string, v interface{}) error {
+	b, err := store.TakeRecord(kind, key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Open a new empty store of every kind; They are closed when the test ends
+func openTestStores(t *testing.T) map[string]Store {
+	t.Helper()
+	dir := t.TempDir()
+	stores := make(map[string]Store)
+	for _, kind := range []string{"bolt", "sqlite", "memory"} {
+		if kind == "sqlite" && !sqliteSupported { //Run the tests with -tags sqlite to check it
+			continue
+		}
+		s, err := OpenStore(kind, filepath.Join(dir, kind+".db"))
+		if err != nil {
+			t.Fatalf("cannot open the %s store: %v", kind, err)
+		}
+		t.Cleanup(func() { _ = s.Close() })
+		stores[kind] = s
+	}
+	return stores
+}
+
+//Every store must behave the same; The bot only sees the Store interface
+func TestStoreContract(t *testing.T) {
+	for kind, s := range openTestStores(t) {
+		s := s
+		t.Run(kind, func(t *testing.T) {
+			t.Run("values", func(t *testing.T) { testStoreValues(t, s) })
+			t.Run("reveal", func(t *testing.T) { testStoreReveal(t, s) })
+			t.Run("pool", func(t *testing.T) { testStorePool(t, s) })
+			t.Run("jobs", func(t *testing.T) { testStoreJobs(t, s) })
+			t.Run("records", func(t *testing.T) { testStoreRecords(t, s) })
+			t.Run("stats", func(t *testing.T) { testStoreStats(t, s) })
+			if dumper, ok := s.(dumpStore); ok { //Last because it clears the store
+				t.Run("dump", func(t *testing.T) { testStoreDump(t, s, dumper) })
+			}
+		})
+	}
+}
+
+func testStoreValues(t *testing.T, s Store) {
+	token, err := s.InsertValue("first", tokenMeta{MaxUses: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.HasKey(token) || s.HasKey("missing") {
+		t.Errorf("HasKey is wrong")
+	}
+	if value, err := s.ReadValue(token); err != nil || value != "first" {
+		t.Errorf("ReadValue = %q, %v; want first", value, err)
+	}
+	if meta, err := s.ReadMeta(token); err != nil || meta.MaxUses != 2 || meta.Created.IsZero() {
+		t.Errorf("ReadMeta = %+v, %v; want the limit and the creation time", meta, err)
+	}
+
+	if err = s.UpdateValue(token, "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := s.ReadValue(token); value != "changed" {
+		t.Errorf("ReadValue after UpdateValue = %q", value)
+	}
+	if err = s.UpdateValue("missing", "x"); err == nil {
+		t.Error("UpdateValue of a missing token succeeded")
+	}
+
+	if err = s.UpdateMeta(token, func(m *tokenMeta) error { m.Protect = true; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.UpdateMeta(token, func(m *tokenMeta) error { m.Protect = false; return errNotSupported }); err != errNotSupported {
+		t.Errorf("UpdateMeta did not return the error of update: %v", err)
+	}
+	if meta, _ := s.ReadMeta(token); !meta.Protect || meta.MaxUses != 2 {
+		t.Errorf("UpdateMeta saved %+v; a failed update must not change it", meta)
+	}
+	if err = s.UpdateMeta("missing", func(*tokenMeta) error { return nil }); err == nil {
+		t.Error("UpdateMeta of a missing token succeeded")
+	}
+
+	results, err := s.InsertValues([]bulkValue{{Key: "custom", Value: "a"}, {Key: "custom", Value: "b"}, {Value: "c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Token != "custom" || results[0].Err != nil || results[1].Err == nil || results[2].Err != nil || results[2].Token == "" {
+		t.Errorf("InsertValues = %+v; want the duplicate key to fail alone", results)
+	}
+	values, err := s.ListAllValues()
+	if err != nil || len(values) != 3 || values["custom"] != "a" || values[token] != "changed" || values[results[2].Token] != "c" {
+		t.Errorf("ListAllValues = %v, %v", values, err)
+	}
+	keys, err := s.ListKeys()
+	if err != nil || len(keys) != 3 || !sort.StringsAreSorted(keys) {
+		t.Errorf("ListKeys = %v, %v; want 3 sorted keys", keys, err)
+	}
+
+	if err = s.RemoveKey("custom"); err != nil {
+		t.Fatal(err)
+	}
+	if s.HasKey("custom") {
+		t.Error("the removed token still exists")
+	}
+	if err = s.RemoveKey("custom"); err == nil {
+		t.Error("RemoveKey of a missing token succeeded")
+	}
+	for _, key := range []string{token, results[2].Token} {
+		if err = s.RemoveKey(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testStoreReveal(t *testing.T, s Store) {
+	limited, _ := s.InsertValue("limited", tokenMeta{MaxUses: 2})
+	expired, _ := s.InsertValue("expired", tokenMeta{Expire: time.Now().Add(-time.Minute)})
+	later, _ := s.InsertValue("later", tokenMeta{NotBefore: time.Now().Add(time.Hour)})
+	for i := 0; i < 2; i++ {
+		if value, err := s.RevealValue(limited); err != nil || value != "limited" {
+			t.Errorf("RevealValue #%d = %q, %v", i+1, value, err)
+		}
+	}
+	if _, err := s.RevealValue(limited); err != errTokenUsedUp {
+		t.Errorf("RevealValue after the limit = %v; want errTokenUsedUp", err)
+	}
+	if meta, _ := s.ReadMeta(limited); meta.Uses != 2 {
+		t.Errorf("Uses = %d; want 2", meta.Uses)
+	}
+	if _, err := s.RevealValue(expired); err != errTokenExpired {
+		t.Errorf("RevealValue of an expired token = %v; want errTokenExpired", err)
+	}
+	if _, err := s.RevealValue(later); err != errNotReleased {
+		t.Errorf("RevealValue before the release = %v; want errNotReleased", err)
+	}
+	if _, err := s.RevealValue("missing"); err == nil {
+		t.Error("RevealValue of a missing token succeeded")
+	}
+}
+
+func testStorePool(t *testing.T, s Store) {
+	token, _ := s.InsertValue("pool", tokenMeta{Pool: true})
+	if err := s.AddPoolItems(token, []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddPoolItems(token, []string{"c"}); err != nil {
+		t.Fatal(err)
+	}
+	claims := []struct {
+		user      int
+		item      string
+		remaining int
+		claimed   bool
+	}{
+		{1, "a", 2, true},
+		{2, "b", 1, true},
+		{1, "a", 1, false}, //The same user gets the same item
+		{3, "c", 0, true},
+	}
+	for _, c := range claims {
+		item, remaining, claimed, err := s.ClaimPoolItem(token, c.user)
+		if err != nil || item != c.item || remaining != c.remaining || claimed != c.claimed {
+			t.Errorf("ClaimPoolItem(%d) = %q, %d, %v, %v; want %q, %d, %v", c.user, item, remaining, claimed, err, c.item, c.remaining, c.claimed)
+		}
+	}
+	if _, _, _, err := s.ClaimPoolItem(token, 4); err != errPoolEmpty {
+		t.Errorf("ClaimPoolItem of an empty pool = %v; want errPoolEmpty", err)
+	}
+	if total, claimed, err := s.PoolStatus(token); err != nil || total != 3 || claimed != 3 {
+		t.Errorf("PoolStatus = %d, %d, %v; want 3, 3", total, claimed, err)
+	}
+	changed, err := s.RewritePoolItems(token, func(item string) (string, error) {
+		if item == "b" {
+			return item, nil
+		}
+		return item + "!", nil
+	})
+	if err != nil || changed != 2 {
+		t.Errorf("RewritePoolItems = %d, %v; want 2", changed, err)
+	}
+	if item, _, _, _ := s.ClaimPoolItem(token, 3); item != "c!" {
+		t.Errorf("ClaimPoolItem after RewritePoolItems = %q; want c!", item)
+	}
+	if total, _, err := s.PoolStatus("missing"); err != nil || total != 0 {
+		t.Errorf("PoolStatus of a token without pool = %d, %v", total, err)
+	}
+}
+
+func testStoreJobs(t *testing.T, s Store) {
+	now := time.Now()
+	for i, at := range []time.Time{now.Add(-time.Minute), now.Add(time.Hour), now} {
+		if err := s.AddJob(scheduledJob{At: at, Kind: "test", Data: []byte(fmt.Sprint(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	due, err := s.DueJobs(now)
+	if err != nil || len(due) != 2 {
+		t.Fatalf("DueJobs = %v, %v; want 2 jobs", due, err)
+	}
+	if due, _ = s.DueJobs(now); len(due) != 0 {
+		t.Errorf("DueJobs returned %d jobs again", len(due))
+	}
+	due, _ = s.DueJobs(now.Add(2 * time.Hour))
+	if len(due) != 1 || due[0].Kind != "test" || string(due[0].Data) != "1" || !due[0].At.Equal(now.Add(time.Hour)) {
+		t.Errorf("DueJobs = %+v; want the later job", due)
+	}
+}
+
+func testStoreRecords(t *testing.T, s Store) {
+	if _, err := s.GetRecord("test", "a"); err != errRecordNotFound {
+		t.Errorf("GetRecord of a missing record = %v; want errRecordNotFound", err)
+	}
+	for key, value := range map[string]string{"a": "1", "b": "2"} {
+		if err := s.PutRecord("test", key, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.PutRecord("other", "a", []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutRecord("test", "b", []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := s.GetRecord("test", "b"); err != nil || string(value) != "3" {
+		t.Errorf("GetRecord = %q, %v; want the replaced value", value, err)
+	}
+	records := make(map[string]string)
+	err := s.ForEachRecord("test", func(key string, value []byte) error {
+		records[key] = string(value)
+		return nil
+	})
+	if err != nil || len(records) != 2 || records["a"] != "1" || records["b"] != "3" {
+		t.Errorf("ForEachRecord = %v, %v", records, err)
+	}
+	if value, err := s.TakeRecord("test", "a"); err != nil || string(value) != "1" {
+		t.Errorf("TakeRecord = %q, %v", value, err)
+	}
+	if _, err := s.TakeRecord("test", "a"); err != errRecordNotFound {
+		t.Errorf("second TakeRecord = %v; want errRecordNotFound", err)
+	}
+	if err := s.DeleteRecord("test", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetRecord("test", "b"); err != errRecordNotFound {
+		t.Errorf("GetRecord of a deleted record = %v; want errRecordNotFound", err)
+	}
+	if err := s.DeleteRecord("test", "b"); err != nil {
+		t.Errorf("DeleteRecord of a missing record = %v", err)
+	}
+	if value, err := s.GetRecord("other", "a"); err != nil || string(value) != "other" {
+		t.Errorf("the records of the other kinds are changed: %q, %v", value, err)
+	}
+
+	err = s.UpdateRecord("test", "c", func(value []byte) ([]byte, error) {
+		if value != nil {
+			t.Errorf("UpdateRecord of a missing record got %q", value)
+		}
+		return []byte("new"), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.UpdateRecord("test", "c", func(value []byte) ([]byte, error) {
+		return append(value, "er"...), nil
+	})
+	if value, _ := s.GetRecord("test", "c"); err != nil || string(value) != "newer" {
+		t.Errorf("UpdateRecord saved %q, %v; want newer", value, err)
+	}
+	err = s.UpdateRecord("test", "c", func([]byte) ([]byte, error) {
+		return []byte("lost"), errRecordExists
+	})
+	if value, _ := s.GetRecord("test", "c"); err != errRecordExists || string(value) != "newer" {
+		t.Errorf("UpdateRecord saved %q, %v; a failed update must not change it", value, err)
+	}
+}
+
+//Export, change the store and import the dump with both modes
+func testStoreDump(t *testing.T, s Store, dumper dumpStore) {
+	changed, err := s.InsertValue("exported", tokenMeta{MaxUses: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err := s.InsertValue("removed", tokenMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.PutRecord("dump", "a", []byte("exported")); err != nil {
+		t.Fatal(err)
+	}
+	var dump bytes.Buffer
+	if err = dumper.Export(&dump); err != nil {
+		t.Fatal(err)
+	}
+	exported := dump.Bytes()
+
+	if err = s.UpdateValue(changed, "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.RemoveKey(removed); err != nil {
+		t.Fatal(err)
+	}
+	added, err := s.InsertValue("added", tokenMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.PutRecord("dump", "a", []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	check := func(mode, token, want string) {
+		t.Helper()
+		if value, err := s.ReadValue(token); want == "" && err == nil {
+			t.Errorf("%s: %s = %q; want it removed", mode, token, value)
+		} else if want != "" && value != want {
+			t.Errorf("%s: %s = %q, %v; want %q", mode, token, value, err, want)
+		}
+	}
+
+	//Merging keeps the current values and only adds the missing ones
+	if err = dumper.Import(bytes.NewReader(exported), false); err != nil {
+		t.Fatal(err)
+	}
+	check("merge", changed, "changed")
+	check("merge", removed, "removed")
+	check("merge", added, "added")
+	if value, _ := s.GetRecord("dump", "a"); string(value) != "changed" {
+		t.Errorf("merge: the record is %q; want changed", value)
+	}
+
+	//Overwriting brings back the exported database
+	if err = dumper.Import(bytes.NewReader(exported), true); err != nil {
+		t.Fatal(err)
+	}
+	check("overwrite", changed, "exported")
+	check("overwrite", removed, "removed")
+	check("overwrite", added, "")
+	if meta, err := s.ReadMeta(changed); err != nil || meta.MaxUses != 4 {
+		t.Errorf("overwrite: ReadMeta = %+v, %v; want the exported limit", meta, err)
+	}
+	if value, _ := s.GetRecord("dump", "a"); string(value) != "exported" {
+		t.Errorf("overwrite: the record is %q; want exported", value)
+	}
+
+	if err = dumper.Import(strings.NewReader("not a dump"), false); err == nil {
+		t.Error("Import accepted an invalid dump")
+	}
+}
+
+func TestJSONRecordHelpers(t *testing.T) {
+	defer func(s Store) { store = s }(store)
+	for kind, s := range openTestStores(t) {
+		store = s
+		t.Run(kind, func(t *testing.T) {
+			if err := replaceJSONRecord("test", "a", 1); err != errRecordNotFound {
+				t.Errorf("replaceJSONRecord of a missing record = %v; want errRecordNotFound", err)
+			}
+			if added, err := addJSONRecord("test", "a", 1); err != nil || !added {
+				t.Errorf("addJSONRecord = %v, %v; want it added", added, err)
+			}
+			if added, err := addJSONRecord("test", "a", 2); err != nil || added {
+				t.Errorf("addJSONRecord of an existing record = %v, %v; want false", added, err)
+			}
+			if err := replaceJSONRecord("test", "a", 3); err != nil {
+				t.Error(err)
+			}
+			var v int
+			if err := getJSONRecord("test", "a", &v); err != nil || v != 3 {
+				t.Errorf("the record is %d, %v; want 3", v, err)
+			}
+		})
+	}
+}
+
+func testStoreStats(t *testing.T, s Store) {
+	token, _ := s.InsertValue("stats", tokenMeta{})
+	events := []struct {
+		source string
+		user   int
+		event  statEvent
+	}{
+		{"", 1, statRequest}, {"", 1, statPass}, {"ads", 2, statRequest}, {"ads", 2, statFail}, {"ads", 3, statRequest},
+	}
+	for _, e := range events {
+		if err := s.RecordStat(token, e.source, e.user, e.event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.RecordStat("missing", "", 1, statRequest); err != nil {
+		t.Errorf("RecordStat of a missing token = %v", err)
+	}
+	report, err := s.ReadStats(token)
+	if err != nil || report.Total != (tokenStats{Requests: 3, Pass: 1, Fail: 1}) || report.UniqueUsers != 3 || report.Sources["ads"].Requests != 2 {
+		t.Errorf("ReadStats = %+v, %v", report, err)
+	}
+	if reports, users, err := s.ReadAllStats(); err != nil || len(reports) == 0 || users < 3 {
+		t.Errorf("ReadAllStats = %d reports, %d users, %v", len(reports), users, err)
+	}
+}
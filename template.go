@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+//Replace the placeholders of a value with the information of the user who receives it
+//{sig} is the hex of HMAC-SHA256 of the user ID with the TemplateSecret of config; So backends can verify the user ID
+func renderValue(value, token string, user tgbotapi.User) string {
+	if !strings.Contains(value, "{") {
+		return value
+	}
+	escape := func(s string) string { return s }
+	if isLink(value) { //Names can have characters like & or # which change the link
+		escape = url.QueryEscape
+	}
+	id := strconv.Itoa(user.ID)
+	placeholders := []string{
+		"{first_name}", escape(user.FirstName),
+		"{last_name}", escape(user.LastName),
+		"{username}", escape(user.UserName),
+		"{user_id}", id,
+		"{token}", escape(token),
+		"{date}", time.Now().Format(dayFormat),
+	}
+	if Config.TemplateSecret != "" {
+		mac := hmac.New(sha256.New, []byte(Config.TemplateSecret))
+		mac.Write([]byte(id))
+		placeholders = append(placeholders, "{sig}", hex.EncodeToString(mac.Sum(nil)))
+	}
+	return strings.NewReplacer(placeholders...).Replace(value)
+}
+
+//Check if the whole value is a http or https link
+func isLink(value string) bool {
+	value = strings.TrimSpace(value)
+	if strings.ContainsAny(value, " \t\n") {
+		return false
+	}
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+func TestRenderValue(t *testing.T) {
+	user := tgbotapi.User{ID: 1234, FirstName: "Sam & Co", LastName: "#1", UserName: "sam"}
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"no placeholders", "no placeholders"},
+		{"Hello {first_name} {last_name} ({username}, {user_id}) of {token}", "Hello Sam & Co #1 (sam, 1234) of tok"},
+		{"https://example.com/download?name={first_name}&user={user_id}#{last_name}", "https://example.com/download?name=Sam+%26+Co&user=1234#%231"},
+		{" http://example.com/?u={username} ", " http://example.com/?u=sam "},
+		{"Download from https://example.com/?name={first_name}", "Download from https://example.com/?name=Sam & Co"}, //Not a link as a whole
+	}
+	for _, test := range tests {
+		if got := renderValue(test.value, "tok", user); got != test.want {
+			t.Errorf("renderValue(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
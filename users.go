@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+//Kind of the records of the users; Their keys are the user IDs
+const userRecords = "user"
+
+//A user who has used the bot
+type botUser struct {
+	ID           int
+	FirstName    string
+	LastName     string
+	UserName     string
+	LanguageCode string
+	Language     string //Chosen with /language; Empty to use LanguageCode
+	FirstSeen    time.Time
+	LastSeen     time.Time
+	Tokens       []string //The tokens which the user has received
+	Blocked      bool     //The user has blocked the bot
+}
+
+//Users are read and written back so the updates must not run together
+var usersMux sync.Mutex
+
+//Read a user, change it and save it; Users which do not exist are created
+func updateUser(id int, update func(u *botUser)) {
+	usersMux.Lock()
+	defer usersMux.Unlock()
+	var u botUser
+	if err := getJSONRecord(userRecords, strconv.Itoa(id), &u); err != nil && err != errRecordNotFound {
+		log.Println("Cannot read the user", id, ":", err.Error())
+		return
+	}
+	u.ID = id
+	update(&u)
+	if err := putJSONRecord(userRecords, strconv.Itoa(id), u); err != nil {
+		log.Println("Cannot save the user", id, ":", err.Error())
+	}
+}
+
+//Save the user who sent a message
+func touchUser(from tgbotapi.User) {
+	updateUser(from.ID, func(u *botUser) {
+		u.FirstName, u.LastName, u.UserName, u.LanguageCode = from.FirstName, from.LastName, from.UserName, from.LanguageCode
+		u.LastSeen = time.Now()
+		if u.FirstSeen.IsZero() {
+			u.FirstSeen = u.LastSeen
+		}
+		u.Blocked = false //Users cannot message the bot if they have blocked it
+	})
+}
+
+//Remember that the user has received the value of a token
+func registerReveal(id int, token string) {
+	updateUser(id, func(u *botUser) {
+		for _, t := range u.Tokens {
+			if t == token {
+				return
+			}
+		}
+		u.Tokens = append(u.Tokens, token)
+	})
+}
+
+//The user has blocked the bot; The ID of the private chat of a user is the ID of the user
+func markBlocked(chatID int64) {
+	updateUser(int(chatID), func(u *botUser) {
+		u.Blocked = true
+	})
+}
+
+//The users who have not blocked the bot; If token is not empty, only the users who received it
+func readUsers(token string) ([]botUser, error) {
+	var users []botUser
+	err := store.ForEachRecord(userRecords, func(_ string, value []byte) error {
+		var u botUser
+		if err := json.Unmarshal(value, &u); err != nil {
+			log.Println("Skipping corrupted user:", err.Error())
+			return nil
+		}
+		if u.Blocked {
+			return nil
+		}
+		if token == "" {
+			users = append(users, u)
+			return nil
+		}
+		for _, t := range u.Tokens {
+			if t == token {
+				users = append(users, u)
+				break
+			}
+		}
+		return nil
+	})
+	return users, err
+}
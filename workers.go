@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	defaultWorkers     = 8
+	defaultWorkerQueue = 64
+)
+
+//Workers which handle the updates. The updates of a user always go to the same worker,
+//so they are handled in order and cannot race, for example on the captcha of the user
+type workerPool struct {
+	queues []chan tgbotapi.Update
+}
+
+//Start the workers; Zero values use the defaults
+func startWorkers(workers, queueSize int) *workerPool {
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	if queueSize <= 0 {
+		queueSize = defaultWorkerQueue
+	}
+	pool := &workerPool{queues: make([]chan tgbotapi.Update, workers)}
+	for i := range pool.queues {
+		pool.queues[i] = make(chan tgbotapi.Update, queueSize)
+		go func(queue chan tgbotapi.Update) {
+			for update := range queue {
+				handleUpdate(update)
+			}
+		}(pool.queues[i])
+	}
+	return pool
+}
+
+//Give the update to the worker of its user. If the queue of the worker is full this waits,
+//so the bot stops receiving the updates until the workers catch up
+func (pool *workerPool) dispatch(update tgbotapi.Update) {
+	queue := pool.queues[updateSender(update)%len(pool.queues)]
+	select {
+	case queue <- update:
+	default:
+		log.Println("The workers are busy; Waiting for them to receive more updates")
+		queue <- update
+	}
+}
+
+//The user who sent the update; Zero if it has no user
+func updateSender(update tgbotapi.Update) int {
+	var id int
+	switch {
+	case update.CallbackQuery != nil:
+		id = update.CallbackQuery.From.ID
+	case update.Message != nil && update.Message.From != nil:
+		id = update.Message.From.ID
+	}
+	if id < 0 {
+		id = -id
+	}
+	return id
+}